@@ -4,9 +4,16 @@ package blackmail
 // This file contains the public API to create messages.
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 )
 
 // Body returns a new part with the given Content-Type.
@@ -34,6 +41,45 @@ func BodyHTML(body []byte, images ...bodyPart) bodyPart {
 	}
 }
 
+// BodyTextCharset returns a new text/plain part which is sent in the given
+// charset, rather than UTF-8.
+//
+// The body should be UTF-8, and is converted when the message is created. The
+// charset must be in Charsets.
+func BodyTextCharset(charset string, body []byte) bodyPart {
+	return withCharset("BodyTextCharset", charset, BodyText(body))
+}
+
+// BodyHTMLCharset returns a new text/html part which is sent in the given
+// charset, rather than UTF-8.
+//
+// This works like BodyTextCharset(); make sure any <meta charset> in the HTML
+// matches.
+func BodyHTMLCharset(charset string, body []byte, images ...bodyPart) bodyPart {
+	return withCharset("BodyHTMLCharset", charset, BodyHTML(body, images...))
+}
+
+// Charsets are the charsets that can be used with BodyTextCharset() and
+// BodyHTMLCharset(), with the lower-case name as the key. The function converts
+// UTF-8 text to that charset.
+//
+// Only UTF-8, US-ASCII, and ISO-8859-1 are supported by default. Other
+// charsets can be added with e.g. golang.org/x/text/encoding:
+//
+//    blackmail.Charsets["shift_jis"] = func(b []byte) ([]byte, error) {
+//        return japanese.ShiftJIS.NewEncoder().Bytes(b)
+//    }
+//
+// The function may be called concurrently, so it shouldn't share state between
+// calls: an encoding.Encoder is stateful and can't be re-used.
+//
+// The map isn't safe for concurrent use; add charsets before sending.
+var Charsets = map[string]func([]byte) ([]byte, error){
+	"utf-8":      func(b []byte) ([]byte, error) { return b, nil },
+	"us-ascii":   encodeASCII,
+	"iso-8859-1": encodeLatin1,
+}
+
 // BodyMust sets the body using a callback, propagating any errors back up.
 //
 // This is useful when using Go templates for the mail body;
@@ -84,12 +130,147 @@ func BodyMustHTML(fn func() ([]byte, error)) bodyPart {
 	return BodyMust("text/html", fn)
 }
 
+// BodyQuote returns a new text/plain part with every line of previous prefixed
+// with "> ", for quoting a previous message in a reply.
+func BodyQuote(previous []byte) bodyPart {
+	lines := quoteLines(previous)
+	for i := range lines {
+		if lines[i] == "" || lines[i][0] == '>' {
+			lines[i] = ">" + lines[i]
+		} else {
+			lines[i] = "> " + lines[i]
+		}
+	}
+	return BodyText([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// BodyQuoteHTML returns a new text/html part with the text in previous in a
+// <blockquote>, for quoting a previous message in a reply.
+func BodyQuoteHTML(previous []byte) bodyPart {
+	lines := quoteLines(previous)
+	for i := range lines {
+		lines[i] = html.EscapeString(lines[i])
+	}
+	return BodyHTML([]byte(`<blockquote type="cite">` + strings.Join(lines, "<br>\n") + "</blockquote>\n"))
+}
+
 // Attachment returns a new attachment part with the given Content-Type.
 //
 // It will try to guess the Content-Type if empty.
 func Attachment(contentType, filename string, body []byte) bodyPart {
-	contentType, filename, cid := attach(contentType, filename, body)
-	return bodyPart{ct: contentType, filename: filename, attach: true, body: body, cid: cid}
+	contentType, filename, cid, err := attach(contentType, filename, body)
+	return bodyPart{ct: contentType, filename: filename, attach: true, body: body, cid: cid, err: err}
+}
+
+// AttachFile returns a new attachment part from a file on disk.
+//
+// The filename is set to the last element of the path, and the Content-Type is
+// guessed from the extension or contents.
+func AttachFile(path string) bodyPart {
+	return AttachFileAs(path, "", "")
+}
+
+// AttachFileAs is like AttachFile(), but sets the filename and Content-Type.
+// They're guessed like AttachFile() if empty.
+func AttachFileAs(path, filename, contentType string) bodyPart {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return bodyPart{err: fmt.Errorf("blackmail.AttachFile: %w", err)}
+	}
+	if filename == "" {
+		filename = filepath.Base(path)
+	}
+	return Attachment(contentType, filename, body)
+}
+
+// AttachmentReader returns a new attachment part which is read from r when the
+// message is created, rather than keeping it all in memory first.
+//
+// The Content-Type is guessed from the filename extension if empty; it's an
+// error if the extension isn't known, as the data can't be sniffed. The reader
+// is only read once, so the part can't be re-used for multiple messages.
+//
+// The size of the attachment isn't counted in HeadersOriginalSize().
+func AttachmentReader(contentType, filename string, r io.Reader) bodyPart {
+	contentType, filename, cid, err := attachReader(contentType, filename)
+	return bodyPart{ct: contentType, filename: filename, attach: true, r: r, cid: cid, err: err}
+}
+
+// AttachPGPKey returns a new application/pgp-keys part with the ASCII-armored
+// public key (RFC 3156 section 7), so recipients can import it to verify the
+// signature.
+//
+// The key is sent as-is with the 7bit encoding; LF line endings are converted
+// to CRLF.
+func AttachPGPKey(pub []byte) bodyPart {
+	key := strings.ReplaceAll(strings.ReplaceAll(string(pub), "\r\n", "\n"), "\n", "\r\n")
+	var err error
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		err = errors.New("blackmail.AttachPGPKey: not an ASCII-armored public key")
+	}
+	return bodyPart{ct: "application/pgp-keys", cte: "7bit", body: []byte(key), err: err}
+}
+
+// Type sets the Content-Type of a part, overriding the type that was passed or
+// detected:
+//
+//    Attachment("", "report.bin", data).Type("application/pdf")
+func (p bodyPart) Type(contentType string) bodyPart {
+	if p.ct == "HEADERS" || p.ct == "OPTION" || p.isMultipart() {
+		p.err = fmt.Errorf("blackmail.Type: can't set Content-Type on %q part", p.ct)
+		return p
+	}
+	p.ct = contentType
+	return p
+}
+
+// ContentType gets the Content-Type of a part, without any parameters.
+func (p bodyPart) ContentType() string { return p.ct }
+
+// Filename gets the filename of an attachment or inline image, or an empty
+// string for other parts.
+func (p bodyPart) Filename() string { return p.filename }
+
+// Encoder sets a custom quoted-printable encoder for a text part, instead of
+// the default mime/quotedprintable writer. This is useful if you want to
+// control which characters are encoded, for example to always encode trailing
+// whitespace or to keep some characters literal.
+//
+// The returned writer must produce valid quoted-printable output; this isn't
+// checked.
+func (p bodyPart) Encoder(fn func(io.Writer) io.WriteCloser) bodyPart {
+	if !p.isText() {
+		p.err = fmt.Errorf("blackmail.Encoder: can't set encoder on %q part", p.ct)
+		return p
+	}
+	p.enc = fn
+	return p
+}
+
+// TransferEncoding sets the Content-Transfer-Encoding of a part, instead of the
+// default of quoted-printable for text and base64 for everything else. It can be
+// one of:
+//
+//    7bit               Written as-is; must be ASCII with CRLF line endings and
+//                       lines no longer than 998 characters.
+//    8bit               Like 7bit, but bytes above 127 are allowed.
+//    binary             Written as-is; this is only valid if the server
+//                       supports BINARYMIME, which isn't checked.
+//    quoted-printable   Encoded with mime/quotedprintable, or the Encoder().
+//    base64             Encoded as base64.
+//
+// The body must already be in the given encoding for 7bit, 8bit, and binary.
+func (p bodyPart) TransferEncoding(cte string) bodyPart {
+	cte = strings.ToLower(cte)
+	switch {
+	case p.isMultipart() || p.ct == "HEADERS" || p.ct == "OPTION":
+		p.err = fmt.Errorf("blackmail.TransferEncoding: can't set transfer encoding on %q part", p.ct)
+	case cte != "7bit" && cte != "8bit" && cte != "binary" && cte != "quoted-printable" && cte != "base64":
+		p.err = fmt.Errorf("blackmail.TransferEncoding: unknown encoding %q", cte)
+	default:
+		p.cte = cte
+	}
+	return p
 }
 
 // InlineImage returns a new inline image part.
@@ -100,15 +281,49 @@ func Attachment(contentType, filename string, body []byte) bodyPart {
 //
 //    <img src="cid:blackmail:1">     First InlineImage()
 //    <img src="cid:blackmail:2">     Second InlineImage()
+//
+// Use InlineImageRef() to get a reference that doesn't depend on the order.
 func InlineImage(contentType, filename string, body []byte) bodyPart {
-	contentType, filename, cid := attach(contentType, filename, body)
-	return bodyPart{ct: contentType, filename: filename, inlineAttach: true, body: body, cid: cid}
+	contentType, filename, cid, err := attach(contentType, filename, body)
+	return bodyPart{ct: contentType, filename: filename, inlineAttach: true, body: body, cid: cid, err: err}
+}
+
+// InlineImageRef is like InlineImage(), but also returns the "cid:" URL to
+// reference it with, rather than relying on "cid:blackmail:<n>" placeholders:
+//
+//    img, ref := InlineImageRef("image/png", "logo.png", logo)
+//    BodyHTML([]byte(fmt.Sprintf(`<img src="%s">`, ref)), img)
+//
+// The image doesn't count towards the placeholder numbers.
+func InlineImageRef(contentType, filename string, body []byte) (bodyPart, string) {
+	p := InlineImage(contentType, filename, body)
+	p.cidSet = true
+	return p, "cid:" + p.cid
+}
+
+// InlineImageCID returns a new inline image part with an explicit Content-ID.
+//
+// Use "cid:<cid>" to reference it; unlike InlineImage() the HTML isn't
+// modified:
+//
+//    InlineImageCID("image/png", "logo.png", "logo@example.com", logo)
+//    <img src="cid:logo@example.com">
+//
+// The angle brackets are removed if present.
+func InlineImageCID(contentType, filename, cid string, body []byte) bodyPart {
+	contentType, filename, _, err := attach(contentType, filename, body)
+	cid = strings.TrimSuffix(strings.TrimPrefix(cid, "<"), ">")
+	if err == nil && (cid == "" || strings.ContainsAny(cid, "<> \t\r\n\"")) {
+		err = fmt.Errorf("blackmail.InlineImageCID: invalid Content-ID: %q", cid)
+	}
+	return bodyPart{ct: contentType, filename: filename, inlineAttach: true, body: body, cid: cid, cidSet: true, err: err}
 }
 
 // Headers adds the headers to the message.
 //
 // This will override any headers set automatically by the system, such as Date:
-// or Message-Id:
+// or Message-Id: A Date header can be given as RFC 3339 (e.g.
+// "2024-01-02T15:04:05Z") and is reformatted as RFC 5322 requires.
 //
 //   Headers("My-Header", "value",
 //       "Message-Id", "<my-message-id@example.com>")
@@ -119,6 +334,35 @@ func Headers(keyValue ...string) bodyPart {
 	return bodyPart{ct: "HEADERS", headers: keyValue}
 }
 
+// MessageID sets the Message-Id header.
+//
+// The angle brackets are added if they're missing.
+func MessageID(id string) bodyPart {
+	return Headers("Message-Id", msgID(id))
+}
+
+// InReplyTo sets the In-Reply-To header to the Message-Id of the message this
+// is a reply to.
+//
+// The angle brackets are added if they're missing.
+func InReplyTo(msgid string) bodyPart {
+	return Headers("In-Reply-To", msgID(msgid))
+}
+
+// References sets the References header to the Message-Ids of the previous
+// messages in the thread, usually from oldest to newest.
+//
+// The angle brackets are added if they're missing.
+func References(msgids ...string) bodyPart {
+	ids := make([]string, 0, len(msgids))
+	for _, id := range msgids {
+		if id = msgID(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return Headers("References", strings.Join(ids, " "))
+}
+
 // HeadersAutoreply sets headers to indicate this message is a an autoreply.
 //
 // See e.g: https://www.arp242.net/autoreply.html#what-you-need-to-set-on-your-auto-response
@@ -128,6 +372,215 @@ func HeadersAutoreply() bodyPart {
 		"Precedence", "auto_reply")
 }
 
+// HeadersMailer sets the X-Mailer header to "blackmail/[version]", which can be
+// useful for debugging.
+func HeadersMailer() bodyPart {
+	return Headers("X-Mailer", "blackmail/"+Version())
+}
+
+// Version gets the version of blackmail from the build info, or "(devel)" if
+// it's not known.
+func Version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	for _, d := range bi.Deps {
+		if d.Path == "zgo.at/blackmail" {
+			if d.Replace != nil {
+				d = d.Replace
+			}
+			if d.Version == "" {
+				return "(devel)"
+			}
+			return d.Version
+		}
+	}
+	if bi.Main.Path == "zgo.at/blackmail" && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// ListHeaders are the mailing list headers from RFC 2369 and RFC 2919, for use
+// with HeadersMailingList().
+//
+// All the fields except ID are a list of URLs, usually mailto: or https:,
+// which will be added in the order given. Fields that are empty are not added.
+type ListHeaders struct {
+	ID          string // List-Id, e.g. "Go Nuts <golang-nuts.googlegroups.com>"
+	Help        []string
+	Subscribe   []string
+	Unsubscribe []string
+	Post        []string // Use "NO" if posting to the list isn't allowed.
+	Owner       []string
+	Archive     []string
+}
+
+// HeadersMailingList sets the List-* headers for mailing lists.
+//
+//   HeadersMailingList(ListHeaders{
+//       ID:          "Go Nuts <golang-nuts.googlegroups.com>",
+//       Post:        []string{"mailto:golang-nuts@googlegroups.com"},
+//       Unsubscribe: []string{"mailto:golang-nuts+unsubscribe@googlegroups.com"},
+//   })
+func HeadersMailingList(l ListHeaders) bodyPart {
+	var h []string
+	if l.ID != "" {
+		id := l.ID
+		if !strings.Contains(id, "<") {
+			id = "<" + id + ">"
+		}
+		h = append(h, "List-Id", id)
+	}
+	for _, f := range []struct {
+		k string
+		v []string
+	}{
+		{"List-Help", l.Help},
+		{"List-Subscribe", l.Subscribe},
+		{"List-Unsubscribe", l.Unsubscribe},
+		{"List-Post", l.Post},
+		{"List-Owner", l.Owner},
+		{"List-Archive", l.Archive},
+	} {
+		if len(f.v) > 0 {
+			h = append(h, f.k, listURLs(f.v))
+		}
+	}
+	return Headers(h...)
+}
+
+// ListUnsubscribe sets the List-Unsubscribe header (RFC 2369), which many email
+// clients show as an "unsubscribe" button.
+//
+// The URLs must be mailto:, http:, or https: URLs, and are added in the order
+// given.
+func ListUnsubscribe(urls ...string) bodyPart {
+	if err := checkUnsubscribe(urls, false); err != nil {
+		return bodyPart{err: fmt.Errorf("blackmail.ListUnsubscribe: %w", err)}
+	}
+	return Headers("List-Unsubscribe", listURLs(urls))
+}
+
+// ListUnsubscribeOneClick is like ListUnsubscribe(), but also sets the
+// List-Unsubscribe-Post header to allow one-click unsubscribe with a POST
+// request (RFC 8058).
+//
+// At least one of the URLs must be a https: URL.
+func ListUnsubscribeOneClick(urls ...string) bodyPart {
+	if err := checkUnsubscribe(urls, true); err != nil {
+		return bodyPart{err: fmt.Errorf("blackmail.ListUnsubscribeOneClick: %w", err)}
+	}
+	return Headers("List-Unsubscribe", listURLs(urls),
+		"List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+}
+
+// DeterministicBoundary creates the multipart boundaries from a hash of the
+// parts, rather than randomly. This way, the same input will create the same
+// output, which is useful for snapshot tests or content-addressed storage.
+//
+// Note that the Message-Id and Date headers and the Content-ID of attachments
+// will still be different; use Headers() to set Message-Id and Date.
+func DeterministicBoundary() bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.hashBoundary = true }}
+}
+
+// HeadersOriginalSize adds an X-Original-Size header with the total size in
+// bytes of all the parts before they're encoded.
+func HeadersOriginalSize() bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.originalSize = true }}
+}
+
+// BccSelf adds the From address as a Bcc recipient.
+func BccSelf() bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.bccSelf = true }}
+}
+
+// Footer appends text to all text/plain parts and html to all text/html parts,
+// for example to add an unsubscribe link. For HTML, it's added before </body> if
+// there is one.
+//
+// The footer is added as-is, so it should usually start with a newline.
+// Attachments aren't modified.
+func Footer(text, html string) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.footerText, o.footerHTML = text, html }}
+}
+
+// DSNReturn sets whether a delivery status notification (bounce) should include
+// just the headers or the full message (RFC 3461).
+//
+// This is only sent if the server supports DSN.
+func DSNReturn(headers bool) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) {
+		o.dsnReturn = "FULL"
+		if headers {
+			o.dsnReturn = "HDRS"
+		}
+	}}
+}
+
+// EnvelopeID sets the envelope identifier, which is included in a delivery
+// status notification (bounce) so it can be correlated with the original
+// message (RFC 3461).
+//
+// This is only sent if the server supports DSN.
+func EnvelopeID(id string) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.envelopeID = id }}
+}
+
+// ReplyTo sets the Reply-To header.
+//
+// This can be given more than once; duplicate addresses are removed. A Reply-To
+// header set with Headers() takes precedence.
+func ReplyTo(addr ...mail.Address) bodyPart {
+	for _, a := range addr {
+		if _, err := mail.ParseAddress(a.Address); err != nil {
+			return bodyPart{err: fmt.Errorf("blackmail.ReplyTo: %q: %w", a.Address, err)}
+		}
+	}
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.replyTo = append(o.replyTo, addr...) }}
+}
+
+// ReplyToNames sets the Reply-To header from a list of "name", "addr"
+// arguments.
+func ReplyToNames(nameAddr ...string) bodyPart {
+	if len(nameAddr)%2 == 1 {
+		return bodyPart{err: errors.New("blackmail.ReplyToNames: odd argument count")}
+	}
+	addr := make([]mail.Address, len(nameAddr)/2)
+	for i := range addr {
+		addr[i] = mail.Address{Name: nameAddr[i*2], Address: nameAddr[i*2+1]}
+	}
+	return ReplyTo(addr...)
+}
+
+// PlusAddress adds a tag to the local part of the address base, for example:
+//
+//    PlusAddress("support@example.com", "ticket123")  →  support+ticket123@example.com
+//
+// Any existing tag in base is replaced. This is useful to track replies when
+// used with ReplyTo(); note that not all mail servers support this.
+func PlusAddress(base, tag string) (string, error) {
+	at := strings.LastIndexByte(base, '@')
+	if at == -1 {
+		return "", fmt.Errorf("blackmail.PlusAddress: no @ in %q", base)
+	}
+	local, domain := base[:at], base[at+1:]
+	if i := strings.IndexByte(local, '+'); i > -1 {
+		local = local[:i]
+	}
+
+	if tag == "" || strings.ContainsAny(tag, "@\"") {
+		return "", fmt.Errorf("blackmail.PlusAddress: invalid tag %q", tag)
+	}
+	addr := local + "+" + tag + "@" + domain
+	if p, err := mail.ParseAddress(addr); err != nil || p.Address != addr {
+		return "", fmt.Errorf("blackmail.PlusAddress: invalid tag %q", tag)
+	}
+	return addr, nil
+}
+
 // From makes creating a mail.Address a bit more convenient.
 //
 //   mail.Address{Name: "foo, Address: "foo@example.com}
@@ -136,6 +589,16 @@ func From(name, address string) mail.Address {
 	return mail.Address{Name: name, Address: address}
 }
 
+// FromParse parses an address such as "Alice <alice@example.com>" or just
+// "alice@example.com", for example from a configuration file.
+func FromParse(s string) (mail.Address, error) {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return mail.Address{}, fmt.Errorf("blackmail.FromParse: %q: %w", s, err)
+	}
+	return *a, nil
+}
+
 // To sets the To: from a list of email addresses.
 func To(addr ...string) []recipient  { return rcpt("to", addr...) }
 func Cc(addr ...string) []recipient  { return rcpt("cc", addr...) }
@@ -151,8 +614,13 @@ func ToNames(nameAddr ...string) []recipient  { return rcptNames("to", nameAddr.
 func CcNames(nameAddr ...string) []recipient  { return rcptNames("cc", nameAddr...) }
 func BccNames(nameAddr ...string) []recipient { return rcptNames("bcc", nameAddr...) }
 
-// TODO: maybe also add helpers to parse?
-// func ToParse(in string) []recipient { return rcpt(mail.Parse(in)) }
+// ToParse sets the To: from a list of addresses in the format of an email
+// header, such as "Alice <alice@example.com>, bob@example.com".
+//
+// Any parse errors are returned from Message().
+func ToParse(list string) []recipient  { return rcptParse("to", list) }
+func CcParse(list string) []recipient  { return rcptParse("cc", list) }
+func BccParse(list string) []recipient { return rcptParse("bcc", list) }
 
 // TODO: maybe add a From() function too, just so it looks nicer:
 //
@@ -168,7 +636,143 @@ func BccNames(nameAddr ...string) []recipient { return rcptNames("bcc", nameAddr
 //        blackmail.To("Name", "victim@example.com"),
 //        blackmail.Bodyf("I can haz ur bitcoinz?"))
 
+// MaxLineLength is the maximum length of a line in a message, excluding the
+// CRLF.
+//
+// Long headers are folded, but Message() will return an error if a line can't
+// be folded to fit. RFC 5321 limits lines to 998 characters; many servers will
+// reject or truncate anything longer.
+var MaxLineLength = 998
+
+// MessageIDFunc creates the Message-Id for new messages. The angle brackets are
+// added if they're missing.
+//
+// The default is to use "<blackmail-[time]-[random]@[from domain]>" if this is
+// nil. A Message-Id set with MessageID() or Headers() takes precedence.
+var MessageIDFunc func(from mail.Address) string
+
+// RandSource is the source of randomness for MIME boundaries, Message-Id, and
+// Content-Id headers.
+//
+// Message() returns an error if reading from it fails.
+var RandSource io.Reader = rand.Reader
+
+// Errors returned by Message().
+var (
+	ErrNoRecipients = errors.New("blackmail.Message: need at least one recipient")
+	ErrNoBody       = errors.New("blackmail.Message: need at least one body part")
+)
+
+// PartError is returned by Message() if there's an error in one of the parts.
+type PartError struct {
+	Index int // Position of the part, starting at 1 for firstPart.
+	Err   error
+}
+
+func (e PartError) Error() string { return fmt.Sprintf("blackmail.Message part %d: %s", e.Index, e.Err) }
+func (e PartError) Unwrap() error { return e.Err }
+
 // Message formats a message.
 func Message(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) ([]byte, []string, error) {
-	return message(subject, from, rcpt, firstPart, parts...)
+	msg, to, _, err := message(subject, from, rcpt, firstPart, parts...)
+	return msg, to, err
+}
+
+// Recipients gets the envelope recipients that Message() would return, without
+// formatting the message: all To, Cc, and Bcc addresses, and the From address
+// with BccSelf(). Duplicate addresses are removed.
+//
+// The arguments are identical to Message(). Errors in the parts are still
+// reported.
+func Recipients(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) ([]string, error) {
+	var opts msgOpts
+	for i, p := range append([]bodyPart{firstPart}, parts...) {
+		if err := p.firstErr(); err != nil {
+			return nil, PartError{Index: i + 1, Err: err}
+		}
+		if p.ct == "OPTION" {
+			p.opt(&opts)
+		}
+	}
+	if len(rcpt) == 0 && !opts.bccSelf {
+		return nil, ErrNoRecipients
+	}
+	return envelope(from, rcpt, opts)
+}
+
+// MessageHTML formats a message with both a text/plain and text/html part, as
+// a multipart/alternative.
+//
+// This is the same as:
+//
+//    Message(subject, from, rcpt, BodyText(text), BodyHTML(html), parts...)
+func MessageHTML(subject string, from mail.Address, rcpt []recipient, text, html []byte, parts ...bodyPart) ([]byte, []string, error) {
+	return Message(subject, from, rcpt, BodyText(text), append([]bodyPart{BodyHTML(html)}, parts...)...)
+}
+
+// MessageFromEML formats a message from an existing RFC 5322 message, such as a
+// template stored as a .eml file.
+//
+// The From, To, Cc, Bcc, and Subject headers and the body are read from r;
+// other headers are copied as-is, except Date and Message-Id which are set to
+// new values as with Message().
+//
+// Headers() in overrides replace headers with the same name, including
+// recipients:
+//
+//    MessageFromEML(fp,
+//        Headers("Subject", "Welcome, Martin!", "To", "martin@example.com"),
+//        Replace("{{name}}", "Martin"))
+//
+// Any body parts in overrides replace the body from r. Text parts in the
+// message must be UTF-8 or US-ASCII.
+func MessageFromEML(r io.Reader, overrides ...bodyPart) ([]byte, []string, error) {
+	subject, from, rcpt, parts, err := parseEML(r, overrides)
+	if err != nil {
+		return nil, nil, fmt.Errorf("blackmail.MessageFromEML: %w", err)
+	}
+	return Message(subject, from, rcpt, parts[0], parts[1:]...)
+}
+
+// ForceEncoding sets the Content-Transfer-Encoding for all parts in the message,
+// instead of the defaults for the part's type. The encoding must be "base64" or
+// "quoted-printable".
+//
+// This is useful for systems that require the same encoding throughout. PGP
+// signatures are always 7bit, and TransferEncoding() on a part still takes
+// precedence.
+func ForceEncoding(enc string) bodyPart {
+	enc = strings.ToLower(enc)
+	if enc != "base64" && enc != "quoted-printable" {
+		return bodyPart{err: fmt.Errorf("blackmail.ForceEncoding: encoding must be base64 or quoted-printable, not %q", enc)}
+	}
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.forceCTE = enc }}
+}
+
+// PartOrder sets the order of the parts in the message, with less reporting
+// whether part a should come before part b. It's used for the parts in every
+// multipart, after the text and HTML parts and inline images are grouped in a
+// multipart/alternative and multipart/related.
+//
+// The sort is stable, so parts that compare equal keep their original order.
+// The default is to keep the order they were given in. For example, to always
+// put calendar invites last:
+//
+//    PartOrder(func(a, b bodyPart) bool {
+//        return b.ContentType() == "text/calendar" && a.ContentType() != "text/calendar"
+//    })
+func PartOrder(less func(a, b bodyPart) bool) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.partOrder = less }}
+}
+
+// Replace sets a list of old, new string pairs to replace in the Subject and
+// text parts, for example to fill in placeholders in a template.
+//
+// Replacements are done in the order they appear, without overlapping matches,
+// as with strings.NewReplacer(). Attachments aren't modified.
+func Replace(oldnew ...string) bodyPart {
+	if len(oldnew)%2 == 1 {
+		return bodyPart{err: errors.New("blackmail.Replace: odd argument count")}
+	}
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.replace = append(o.replace, oldnew...) }}
 }
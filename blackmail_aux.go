@@ -5,7 +5,10 @@ package blackmail
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -18,9 +21,13 @@ import (
 	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type (
@@ -31,12 +38,36 @@ type (
 		parts        []bodyPart
 		ct           string
 		body         []byte
+		r            io.Reader // Read body from this, instead of body.
 		filename     string
 		attach       bool
 		inlineAttach bool
 
-		headers []string // For Headers()
-		cid     string   // Content-ID reference
+		headers []string                       // For Headers()
+		opt     func(*msgOpts)                 // For message options.
+		enc     func(io.Writer) io.WriteCloser // Custom quoted-printable encoder.
+		cid     string                         // Content-ID reference
+		cidSet  bool                           // cid set with InlineImageCID()
+		charset string                         // Charset for text parts; empty means utf-8.
+		cte     string                         // Content-Transfer-Encoding; empty means the default.
+	}
+
+	// msgOpts are options for the entire message, rather than just one part.
+	msgOpts struct {
+		originalSize   bool
+		replyTo        []mail.Address
+		bccSelf        bool
+		dsnReturn      string
+		envelopeID     string
+		footerText     string
+		footerHTML     string
+		hashBoundary   bool
+		replace        []string
+		forceCTE       string
+		partOrder      func(a, b bodyPart) bool
+		defaultHeaders []string
+		dkim           *DKIMOptions
+		smime          *tls.Certificate
 	}
 
 	// recipient is someone to send an email to. Create a new one with the To*,
@@ -44,6 +75,7 @@ type (
 	recipient struct {
 		mail.Address
 		kind string // to, cc, bcc
+		err  error
 	}
 )
 
@@ -53,30 +85,36 @@ var (
 	stdout       io.Writer = os.Stdout
 	stderr       io.Writer = os.Stderr
 	testBoundary           = ""
-	testRandom             = func() uint64 {
-		r, _ := rand.Int(rand.Reader, big.NewInt(0).SetUint64(999_999))
-		return r.Uint64()
-	}
+	testRandom             = randomID
 )
 
-func message(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) ([]byte, []string, error) {
+func message(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) ([]byte, []string, msgOpts, error) {
 	parts = append([]bodyPart{firstPart}, parts...)
 
 	// Propegate any errors from the parts.
 	for i, p := range parts {
-		if p.err != nil {
-			return nil, nil, fmt.Errorf("blackmail.Message part %d: %w", i+1, p.err)
+		if err := p.firstErr(); err != nil {
+			return nil, nil, msgOpts{}, PartError{Index: i + 1, Err: err}
+		}
+		parts[i] = p.normalizeCRLF()
+		if err := parts[i].check7bit(); err != nil {
+			return nil, nil, msgOpts{}, PartError{Index: i + 1, Err: err}
 		}
 	}
 
-	// Get the extra headers out of the parts.
-	var userHeaders []string
+	// Get the extra headers and options out of the parts.
+	var (
+		userHeaders []string
+		opts        msgOpts
+	)
 	{
 		var np []bodyPart
 		for _, p := range parts {
 			switch p.ct {
 			default:
 				np = append(np, p)
+			case "OPTION":
+				p.opt(&opts)
 			case "HEADERS":
 				for i := range p.headers {
 					if i%2 == 0 {
@@ -88,20 +126,58 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 			}
 		}
 		parts = np
+
+		// Headers from NewMailerHeaders(), unless they're set on the message.
+		n := len(userHeaders)
+		for i := 0; i+1 < len(opts.defaultHeaders); i += 2 {
+			k, set := textproto.CanonicalMIMEHeaderKey(opts.defaultHeaders[i]), false
+			for j := 0; j < n; j += 2 {
+				set = set || userHeaders[j] == k
+			}
+			if !set {
+				userHeaders = append(userHeaders, k, opts.defaultHeaders[i+1])
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return nil, nil, msgOpts{}, ErrNoBody
+	}
+	if len(opts.replace) > 0 {
+		r := strings.NewReplacer(opts.replace...)
+		subject = r.Replace(subject)
+		parts = replaceText(parts, r)
+	}
+	if opts.footerText != "" || opts.footerHTML != "" {
+		parts = footer(parts, opts.footerText, opts.footerHTML)
+	}
+	if opts.forceCTE != "" {
+		parts = forceCTE(parts, opts.forceCTE)
+	}
+	parts, err := transcode(parts)
+	if err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+	}
+	if err := checkCIDs(parts, make(map[string]bool)); err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+	}
+	if len(rcpt) == 0 && !opts.bccSelf {
+		return nil, nil, msgOpts{}, ErrNoRecipients
 	}
 
 	t := now()
 	msg := new(bytes.Buffer)
 
+	toList, err := envelope(from, rcpt, opts)
+	if err != nil {
+		return nil, nil, msgOpts{}, err
+	}
+
 	// Write address headers.
-	var toList []string
 	{
 		writeA(msg, &userHeaders, "From", from)
 
 		var to, cc, bcc []mail.Address
 		for _, r := range rcpt {
-			toList = append(toList, r.Address.Address)
-
 			switch r.kind {
 			case "to":
 				to = append(to, r.Address)
@@ -109,8 +185,6 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 				cc = append(cc, r.Address)
 			case "bcc":
 				bcc = append(bcc, r.Address)
-			default:
-				return nil, nil, fmt.Errorf("blackmail.Message: unknown recipient type: %q", r.kind)
 			}
 		}
 
@@ -123,16 +197,36 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 		if len(to) == 0 && len(bcc) > 0 {
 			writeH(msg, &userHeaders, "To", "undisclosed-recipients:;")
 		}
+		if len(opts.replyTo) > 0 {
+			writeA(msg, &userHeaders, "Reply-To", uniqAddr(opts.replyTo)...)
+		}
+	}
+
+	if err := fixDate(userHeaders); err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
 	}
 
 	// Write other headers.
 	{
-		writeH(msg, &userHeaders, "Message-Id", fmt.Sprintf("<blackmail-%s-%s@%s>",
-			t.UTC().Format("20060102150405.0000"),
-			strconv.FormatUint(testRandom(), 36),
-			from.Address[strings.Index(from.Address, "@")+1:]))
+		var id string
+		if MessageIDFunc != nil {
+			id = msgID(MessageIDFunc(from))
+		} else {
+			r, err := testRandom()
+			if err != nil {
+				return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: creating Message-Id: %w", err)
+			}
+			id = fmt.Sprintf("<blackmail-%s-%s@%s>",
+				t.UTC().Format("20060102150405.0000"),
+				strconv.FormatUint(r, 36),
+				from.Address[strings.Index(from.Address, "@")+1:])
+		}
+		writeH(msg, &userHeaders, "Message-Id", id)
 		writeH(msg, &userHeaders, "Date", t.Format(time.RFC1123Z))
 		writeH(msg, &userHeaders, "Subject", subject)
+		if opts.originalSize {
+			writeH(msg, &userHeaders, "X-Original-Size", strconv.Itoa(originalSize(parts)))
+		}
 
 		for i := range userHeaders {
 			if i%2 == 1 {
@@ -144,7 +238,7 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 
 	// If we have just one text part we don't need to bother with MIME, so just
 	// write out the body and return.
-	if len(parts) == 1 && parts[0].isText() {
+	if len(parts) == 1 && parts[0].isText() && !parts[0].attach {
 		p := parts[0]
 		ct, cte := p.getCTE()
 		fmt.Fprintf(msg, "Content-Type: %s\r\n", ct)
@@ -155,20 +249,27 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 		bw.Write(p.body)
 		bw.Close()
 
-		return msg.Bytes(), toList, nil
+		out, err := finish(msg.Bytes(), opts)
+		if err != nil {
+			return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+		}
+		return out, toList, opts, nil
 	}
 
+	parts = groupParts(parts)
+
 	// Figure out the correct/best multipart/ format.
 	var ct string
 	{
 		if len(parts) == 1 && parts[0].isMultipart() {
 			ct = parts[0].ct
+			parts = parts[0].parts
 		} else if len(parts) > 2 {
 			ct = "multipart/mixed"
 		} else {
 			ct = "multipart/alternative"
 			for _, p := range parts {
-				if !p.isTextPlain() && !p.isTextHTML() && p.ct != "multipart/related" {
+				if p.attach || (!p.isTextPlain() && !p.isTextHTML() && p.ct != "multipart/related") {
 					ct = "multipart/mixed"
 					break
 				}
@@ -176,29 +277,65 @@ func message(subject string, from mail.Address, rcpt []recipient, firstPart body
 		}
 	}
 
+	if opts.partOrder != nil {
+		sortParts(parts, opts.partOrder)
+	}
+
 	// Write the message.
+	newBoundary := func([]bodyPart) (string, error) { return randomBoundary() }
+	if opts.hashBoundary {
+		newBoundary = func(p []bodyPart) (string, error) { return hashBoundary(p), nil }
+	}
 	w := multipart.NewWriter(msg)
+	b, err := newBoundary(parts)
+	if err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+	}
 	if testBoundary != "" {
-		if err := w.SetBoundary(testBoundary); err != nil {
-			return nil, nil, fmt.Errorf("blackmail.Message: %w", err)
-		}
+		b = testBoundary
+	}
+	if err := w.SetBoundary(b); err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
 	}
 
 	fmt.Fprint(msg, "Mime-Version: 1.0\r\n")
 	fmt.Fprintf(msg, "Content-Type: %s;\r\n\tboundary=\"%s\"\r\n\r\n", ct, w.Boundary())
-	bodyMIME(msg, w, parts, from.Address)
+	err = bodyMIME(msg, w, parts, from.Address, newBoundary)
+	if err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+	}
 	w.Close()
 
-	out := msg.Bytes()
+	out, err := finish(msg.Bytes(), opts)
+	if err != nil {
+		return nil, nil, msgOpts{}, fmt.Errorf("blackmail.Message: %w", err)
+	}
+	return out, toList, opts, nil
+}
 
-	return out, toList, nil
+// finish checks the line lengths of the complete message and signs it.
+func finish(msg []byte, opts msgOpts) ([]byte, error) {
+	if err := checkLines(msg); err != nil {
+		return nil, err
+	}
+	if opts.smime != nil {
+		var err error
+		msg, err = smimeSign(msg, *opts.smime, opts.hashBoundary)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.dkim != nil {
+		return DKIMSign(msg, *opts.dkim)
+	}
+	return msg, nil
 }
 
-func bodyMIME(msg io.Writer, w *multipart.Writer, parts []bodyPart, from string) {
-	// Gather all cid: links.
+func bodyMIME(msg io.Writer, w *multipart.Writer, parts []bodyPart, from string, newBoundary func([]bodyPart) (string, error)) error {
+	// Gather all cid: links; explicit ones are referenced by the caller directly.
 	var cids []string
 	for _, p := range parts {
-		if p.cid != "" {
+		if p.cid != "" && !p.cidSet {
 			cids = append(cids, p.cid)
 		}
 	}
@@ -206,9 +343,12 @@ func bodyMIME(msg io.Writer, w *multipart.Writer, parts []bodyPart, from string)
 	for _, p := range parts {
 		// Multipart
 		if p.isMultipart() {
-			b := randomBoundary()
+			b, err := newBoundary(p.parts)
+			if err != nil {
+				return err
+			}
 			if testBoundary != "" {
-				b = testBoundary + "222"
+				b = w.Boundary() + "222"
 			}
 			part, _ := w.CreatePart(textproto.MIMEHeader{
 				"Content-Type": {fmt.Sprintf("%s;\r\n\tboundary=\"%s\"", p.ct, b)},
@@ -216,10 +356,13 @@ func bodyMIME(msg io.Writer, w *multipart.Writer, parts []bodyPart, from string)
 
 			w2 := multipart.NewWriter(part)
 			if err := w2.SetBoundary(b); err != nil {
-				panic(err) // TODO: return error?
+				return err
 			}
 
-			bodyMIME(part, w2, p.parts, from)
+			err = bodyMIME(part, w2, p.parts, from, newBoundary)
+			if err != nil {
+				return err
+			}
 			w2.Close()
 			continue
 		}
@@ -253,26 +396,175 @@ func bodyMIME(msg io.Writer, w *multipart.Writer, parts []bodyPart, from string)
 
 		// Replace cid: references images.
 		if p.isTextHTML() && len(cids) > 0 {
-			for j, cid := range cids {
-				find := fmt.Sprintf(`src="cid:blackmail:%d"`, j+1)
-				p.body = bytes.ReplaceAll(p.body, []byte(find), []byte(`src="cid:`+cid+`"`))
-			}
+			p.body = replaceCIDs(p.body, cids)
 		}
 
 		mp, _ := w.CreatePart(head)
 		bw := p.writer(mp)
-		bw.Write(p.body)
+		if p.r != nil {
+			_, err := io.Copy(bw, p.r)
+			if err != nil {
+				return fmt.Errorf("reading %q: %w", p.filename, err)
+			}
+		} else {
+			bw.Write(p.body)
+		}
 		bw.Close()
 	}
+	return nil
+}
+
+// originalSize gets the size of all parts, before encoding.
+func originalSize(parts []bodyPart) int {
+	var n int
+	for _, p := range parts {
+		n += len(p.body) + originalSize(p.parts)
+	}
+	return n
 }
 
-func randomBoundary() string {
+var (
+	reTag = regexp.MustCompile(`<[a-zA-Z][^>]*(?:>|$)`)
+	reSrc = regexp.MustCompile(`(?i)\ssrc\s*=\s*(["']?)cid:blackmail:(\d+)`)
+)
+
+// replaceCIDs replaces "cid:blackmail:<n>" in src attributes of HTML tags with
+// the Content-ID of the nth inline part.
+//
+// Text outside of tags and references to parts that don't exist are left
+// alone.
+func replaceCIDs(body []byte, cids []string) []byte {
+	return reTag.ReplaceAllFunc(body, func(tag []byte) []byte {
+		var (
+			out  []byte
+			prev int
+		)
+		for _, m := range reSrc.FindAllSubmatchIndex(tag, -1) {
+			quote, end := tag[m[2]:m[3]], m[5]
+			switch {
+			case len(quote) > 0 && (end >= len(tag) || tag[end] != quote[0]):
+				continue // Mismatched quotes, or something like "cid:blackmail:1x".
+			case len(quote) == 0 && (end >= len(tag) || !strings.ContainsRune(" \t\r\n/>", rune(tag[end]))):
+				continue
+			}
+			n, err := strconv.Atoi(string(tag[m[4]:m[5]]))
+			if err != nil || n < 1 || n > len(cids) {
+				continue
+			}
+			out = append(out, tag[prev:m[4]-len("blackmail:")]...)
+			out = append(out, cids[n-1]...)
+			prev = m[5]
+		}
+		if out == nil {
+			return tag
+		}
+		return append(out, tag[prev:]...)
+	})
+}
+
+func randomID() (uint64, error) {
+	r, err := rand.Int(RandSource, big.NewInt(0).SetUint64(999_999))
+	if err != nil {
+		return 0, err
+	}
+	return r.Uint64(), nil
+}
+
+func randomBoundary() (string, error) {
 	var buf [30]byte
-	_, err := io.ReadFull(rand.Reader, buf[:])
+	_, err := io.ReadFull(RandSource, buf[:])
 	if err != nil {
-		panic(err) // Should never fail.
+		return "", fmt.Errorf("creating boundary: %w", err)
+	}
+	return fmt.Sprintf("%x", buf[:]), nil
+}
+
+// groupParts groups the top-level parts in the correct multipart structure:
+//
+//   - Inline images are grouped with the HTML part in a multipart/related.
+//   - If there are also attachments, the text and HTML part are grouped in a
+//     multipart/alternative, so the attachments are siblings of that.
+//
+// The parts are returned as-is if it's not clear how they should be grouped.
+func groupParts(parts []bodyPart) []bodyPart {
+	// Find the index of the text and HTML part.
+	find := func(parts []bodyPart) (int, int, bool) {
+		text, html := -1, -1
+		for i, p := range parts {
+			switch {
+			case p.attach || p.inlineAttach:
+			case p.isTextPlain() && text == -1:
+				text = i
+			case (p.isTextHTML() || p.ct == "multipart/related") && html == -1:
+				html = i
+			default:
+				return -1, -1, false
+			}
+		}
+		return text, html, true
+	}
+
+	text, html, ok := find(parts)
+	if !ok || html == -1 {
+		return parts
+	}
+
+	var (
+		np     = make([]bodyPart, 0, len(parts))
+		inline []bodyPart
+	)
+	for _, p := range parts {
+		if p.inlineAttach {
+			inline = append(inline, p)
+		} else {
+			np = append(np, p)
+		}
+	}
+	if len(inline) > 0 {
+		parts = np
+		text, html, _ = find(parts)
+
+		h := parts[html]
+		if h.isTextHTML() {
+			h = bodyPart{ct: "multipart/related", parts: []bodyPart{h}}
+		}
+		h.parts = append(h.parts[:len(h.parts):len(h.parts)], inline...)
+		parts[html] = h
+	}
+
+	if text == -1 {
+		return parts
+	}
+	if len(parts) == 2 { // The last part in multipart/alternative is preferred.
+		return []bodyPart{parts[text], parts[html]}
+	}
+	np = []bodyPart{{ct: "multipart/alternative", parts: []bodyPart{parts[text], parts[html]}}}
+	for i, p := range parts {
+		if i != text && i != html {
+			np = append(np, p)
+		}
+	}
+	return np
+}
+
+// hashBoundary creates a boundary from the hash of the parts, so that the same
+// parts always have the same boundary.
+func hashBoundary(parts []bodyPart) string {
+	h := sha256.New()
+	var hashParts func([]bodyPart)
+	hashParts = func(parts []bodyPart) {
+		for _, p := range parts {
+			// Include the lengths, so that e.g. ct "ab" + fn "c" is different
+			// from ct "a" + fn "bc".
+			fmt.Fprintf(h, "%d:%s%d:%s%d:", len(p.ct), p.ct, len(p.filename), p.filename, len(p.body))
+			h.Write(p.body)
+			fmt.Fprintf(h, "%d[", len(p.parts))
+			hashParts(p.parts)
+			h.Write([]byte("]"))
+		}
 	}
-	return fmt.Sprintf("%x", buf[:])
+	hashParts(parts)
+	return fmt.Sprintf("%x", h.Sum(nil)[:30])
 }
 
 func isMB(s string) bool {
@@ -290,13 +582,113 @@ func (p bodyPart) isTextPlain() bool { return strings.HasPrefix(p.ct, "text/plai
 func (p bodyPart) isMultipart() bool { return strings.HasPrefix(p.ct, "multipart/") }
 
 func (p bodyPart) getCTE() (string, string) {
+	ct, cte := p.ct, "base64"
 	if p.isText() {
-		return fmt.Sprintf("%s; charset=utf-8", p.ct), "quoted-printable"
+		cs := p.charset
+		if cs == "" {
+			cs = "utf-8"
+		}
+		ct, cte = fmt.Sprintf("%s; charset=%s", p.ct, cs), "quoted-printable"
 	}
 	if p.ct == "application/pgp-signature" {
-		return p.ct, "7bit"
+		cte = "7bit"
+	}
+	if p.cte != "" {
+		cte = p.cte
+	}
+	return ct, cte
+}
+
+// hasReader reports if this part or any of its subparts is read from an
+// io.Reader, which can only be done once.
+func (p bodyPart) hasReader() bool {
+	if p.r != nil {
+		return true
+	}
+	for _, pp := range p.parts {
+		if pp.hasReader() {
+			return true
+		}
 	}
-	return p.ct, "base64"
+	return false
+}
+
+// firstErr gets the first error for this part or any of its subparts.
+func (p bodyPart) firstErr() error {
+	if p.err != nil {
+		return p.err
+	}
+	for _, pp := range p.parts {
+		if err := pp.firstErr(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeCRLF converts bare LF to CRLF in parts with the 7bit or 8bit
+// Content-Transfer-Encoding, as they're written as-is. Bare CR is left alone,
+// and is an error in check7bit().
+func (p bodyPart) normalizeCRLF() bodyPart {
+	if len(p.parts) > 0 {
+		np := make([]bodyPart, len(p.parts))
+		for i := range p.parts {
+			np[i] = p.parts[i].normalizeCRLF()
+		}
+		p.parts = np
+	}
+	if p.ct == "HEADERS" || p.ct == "OPTION" {
+		return p
+	}
+	if _, cte := p.getCTE(); cte != "7bit" && cte != "8bit" {
+		return p
+	}
+	for i, c := range p.body {
+		if c == '\n' && (i == 0 || p.body[i-1] != '\r') {
+			p.body = bytes.ReplaceAll(bytes.ReplaceAll(p.body, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+			break
+		}
+	}
+	return p
+}
+
+// check7bit checks that parts with the 7bit Content-Transfer-Encoding only
+// contain 7bit data, as they're written as-is. Parts with the 8bit encoding are
+// checked too, except that bytes above 127 are allowed.
+//
+// This should be called after normalizeCRLF().
+func (p bodyPart) check7bit() error {
+	for _, pp := range p.parts {
+		if err := pp.check7bit(); err != nil {
+			return err
+		}
+	}
+	if p.ct == "HEADERS" || p.ct == "OPTION" {
+		return nil
+	}
+	_, cte := p.getCTE()
+	if cte != "7bit" && cte != "8bit" {
+		return nil
+	}
+
+	line := 0
+	for i, c := range p.body {
+		switch {
+		case c == 0 || (c > 127 && cte == "7bit"):
+			return fmt.Errorf("%s part has %s encoding but contains byte 0x%02x at position %d", p.ct, cte, c, i)
+		case c == '\r' && (i+1 == len(p.body) || p.body[i+1] != '\n'):
+			return fmt.Errorf("%s part has %s encoding but contains bare CR at position %d", p.ct, cte, i)
+		case c == '\r':
+		case c == '\n':
+			line = 0
+		default:
+			line++
+			if line > 998 {
+				return fmt.Errorf("%s part has %s encoding but contains line longer than 998 characters", p.ct, cte)
+			}
+		}
+	}
+	return nil
 }
 
 type nopCloser struct{ io.Writer }
@@ -305,13 +697,17 @@ func (nopCloser) Close() error             { return nil }
 func NopCloser(r io.Writer) io.WriteCloser { return nopCloser{r} }
 
 func (p bodyPart) writer(msg io.Writer) io.WriteCloser {
-	if p.isText() {
+	switch _, cte := p.getCTE(); cte {
+	case "quoted-printable":
+		if p.enc != nil {
+			return p.enc(msg)
+		}
 		return quotedprintable.NewWriter(msg)
-	}
-	if p.ct == "application/pgp-signature" {
+	case "base64":
+		return newBase64Writer(msg, 76)
+	default:
 		return NopCloser(msg)
 	}
-	return &wrappedBase64{msg}
 }
 
 func rcpt(kind string, addr ...string) []recipient {
@@ -332,9 +728,9 @@ func rcptAddress(kind string, addr ...mail.Address) []recipient {
 
 func rcptNames(kind string, nameAddr ...string) []recipient {
 	if len(nameAddr)%2 == 1 {
-		// would be better to return error, but this would make the API more
-		// awkward. This is probably okay.
-		panic(fmt.Sprintf("blackmail.rcptNames for %q: odd argument count", kind))
+		// The error is returned from Message().
+		return []recipient{{kind: kind, err: fmt.Errorf(
+			"blackmail.%sNames: odd argument count", rcptFunc(kind))}}
 	}
 
 	r := make([]recipient, len(nameAddr)/2)
@@ -347,27 +743,90 @@ func rcptNames(kind string, nameAddr ...string) []recipient {
 	return r
 }
 
-// Write wrapped base64 to w.
-type wrappedBase64 struct{ w io.Writer }
+func rcptParse(kind string, list string) []recipient {
+	addr, err := mail.ParseAddressList(list)
+	if err != nil {
+		// The error is returned from Message().
+		return []recipient{{kind: kind, err: fmt.Errorf(
+			"blackmail.%sParse: %q: %w", rcptFunc(kind), list, err)}}
+	}
+
+	r := make([]recipient, len(addr))
+	for i := range addr {
+		r[i] = recipient{kind: kind, Address: *addr[i]}
+	}
+	return r
+}
+
+// rcptFunc gets the prefix of the function name for a recipient kind: "to" →
+// "To".
+func rcptFunc(kind string) string { return strings.ToUpper(kind[:1]) + kind[1:] }
 
-func (b *wrappedBase64) Close() error { return nil }
+// newBase64Writer returns a writer that writes base64 to w.
+//
+// Lines are wrapped at lineLen characters with CRLF, as is required for email.
+// Use 0 to disable wrapping, which is useful for HTTP APIs which accept base64
+// in JSON where the line breaks just waste space.
+//
+// Close() must be called to flush any remaining data.
+func newBase64Writer(w io.Writer, lineLen int) io.WriteCloser {
+	lw := &lineWrapper{w: w, lineLen: lineLen}
+	return &base64Writer{lw: lw, enc: base64.NewEncoder(base64.StdEncoding, lw)}
+}
 
-func (b *wrappedBase64) Write(p []byte) (n int, err error) {
-	buf := make([]byte, 78)
-	copy(buf[76:], "\r\n")
+type base64Writer struct {
+	lw  *lineWrapper
+	enc io.WriteCloser
+}
 
-	for len(p) >= 57 {
-		base64.StdEncoding.Encode(buf, p[:57])
-		b.w.Write(buf)
-		p = p[57:]
+func (b *base64Writer) Write(p []byte) (int, error) { return b.enc.Write(p) }
+
+func (b *base64Writer) Close() error {
+	err := b.enc.Close()
+	if err != nil {
+		return err
+	}
+	if b.lw.lineLen > 0 && b.lw.col > 0 {
+		_, err = b.lw.w.Write([]byte("\r\n"))
 	}
+	return err
+}
 
-	if len(p) > 0 {
-		base64.StdEncoding.Encode(buf, p)
-		b.w.Write(append(buf[:base64.StdEncoding.EncodedLen(len(p))], "\r\n"...))
+// lineWrapper adds a CRLF after every lineLen bytes.
+type lineWrapper struct {
+	w       io.Writer
+	lineLen int
+	col     int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	if l.lineLen == 0 {
+		return l.w.Write(p)
 	}
 
-	return base64.StdEncoding.EncodedLen(len(p)), nil
+	var n int
+	for len(p) > 0 {
+		c := l.lineLen - l.col
+		if c > len(p) {
+			c = len(p)
+		}
+		nn, err := l.w.Write(p[:c])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+
+		l.col += c
+		if l.col == l.lineLen {
+			_, err := l.w.Write([]byte("\r\n"))
+			if err != nil {
+				return n, err
+			}
+			l.col = 0
+		}
+	}
+	return n, nil
 }
 
 func haveH(headers *[]string, name string) string {
@@ -385,50 +844,610 @@ func haveH(headers *[]string, name string) string {
 	return ""
 }
 
+// fixDate reformats a Date header set with Headers() as RFC 1123Z, which is
+// the format RFC 5322 requires. It can be given as RFC 3339 or any format
+// mail.ParseDate() accepts.
+func fixDate(userHeaders []string) error {
+	for i := 0; i+1 < len(userHeaders); i += 2 {
+		if userHeaders[i] != "Date" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, userHeaders[i+1])
+		if err != nil {
+			t, err = mail.ParseDate(userHeaders[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid Date header %q: %w", userHeaders[i+1], err)
+			}
+		}
+		userHeaders[i+1] = t.Format(time.RFC1123Z)
+	}
+	return nil
+}
+
 func writeH(w io.Writer, userHeaders *[]string, key string, values ...string) {
 	user := haveH(userHeaders, key)
 	if user != "" {
-		fmt.Fprintf(w, "%s: %s\r\n", key, mime.QEncoding.Encode("utf-8", user))
+		w.Write(fold(key, encodeH(user)))
 		return
 	}
 
 	for _, v := range values {
-		fmt.Fprintf(w, "%s: %s\r\n", key, mime.QEncoding.Encode("utf-8", v))
+		w.Write(fold(key, encodeH(v)))
+	}
+}
+
+// encodeH encodes a header value as an RFC 2047 encoded-word if it contains
+// anything other than printable ASCII, and returns it as-is otherwise.
+func encodeH(v string) string {
+	for i := 0; i < len(v); i++ {
+		if (v[i] < ' ' || v[i] > '~') && v[i] != '\t' {
+			return mime.QEncoding.Encode("utf-8", v)
+		}
 	}
+	return v
 }
 
 func writeA(w io.Writer, userHeaders *[]string, key string, addr ...mail.Address) {
-	fmt.Fprintf(w, "%s: ", textproto.CanonicalMIMEHeaderKey(key))
+	key = textproto.CanonicalMIMEHeaderKey(key)
 	user := haveH(userHeaders, key)
 	if user != "" {
-		fmt.Fprintf(w, "%s\r\n", user)
+		w.Write(fold(key, user))
 		return
 	}
 
+	l := make([]string, len(addr))
 	for i, a := range addr {
-		fmt.Fprint(w, a.String())
-		if i != len(addr)-1 {
-			w.Write([]byte(", "))
+		l[i] = a.String()
+	}
+	w.Write(fold(key, strings.Join(l, ", ")))
+}
+
+// checkCIDs checks that all Content-IDs are unique, as cid: references would be
+// ambiguous otherwise.
+func checkCIDs(parts []bodyPart, seen map[string]bool) error {
+	for _, p := range parts {
+		if p.cid != "" {
+			if seen[p.cid] {
+				return fmt.Errorf("duplicate Content-ID %q", p.cid)
+			}
+			seen[p.cid] = true
+		}
+		if err := checkCIDs(p.parts, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fold a header line at whitespace so that lines are at most 78 characters
+// where possible (RFC 5322 2.1.1).
+//
+// Words that are longer than that are kept as-is; message() will return an
+// error if this results in a line longer than MaxLineLength.
+func fold(key, value string) []byte {
+	b := make([]byte, 0, len(key)+len(value)+8)
+	b = append(b, key...)
+	b = append(b, ": "...)
+
+	// Fast path for the common case of short headers.
+	if len(b)+len(value) <= 78 {
+		b = append(b, value...)
+		return append(b, "\r\n"...)
+	}
+
+	line := len(b)
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 {
+			if word != "" && line+1+len(word) > 78 {
+				b = append(b, "\r\n"...)
+				line = 0
+			}
+			b = append(b, ' ')
+			line++
+		}
+		b = append(b, word...)
+		line += len(word)
+	}
+	return append(b, "\r\n"...)
+}
+
+// checkLines checks that no line in msg is longer than MaxLineLength.
+func checkLines(msg []byte) error {
+	for n := 1; len(msg) > 0; n++ {
+		i := bytes.Index(msg, []byte("\r\n"))
+		if i == -1 {
+			i = len(msg)
+		}
+		if i > MaxLineLength {
+			return fmt.Errorf("line %d is %d characters, which is longer than the maximum of %d", n, i, MaxLineLength)
+		}
+		if i+2 > len(msg) {
+			break
+		}
+		msg = msg[i+2:]
+	}
+	return nil
+}
+
+// footer appends the text and html footer to all text/plain and text/html
+// parts that aren't attachments.
+func footer(parts []bodyPart, text, html string) []bodyPart {
+	np := make([]bodyPart, len(parts))
+	for i, p := range parts {
+		switch {
+		case p.attach:
+		case p.isMultipart():
+			p.parts = footer(p.parts, text, html)
+		case p.isTextPlain() && text != "":
+			p.body = append(p.body[:len(p.body):len(p.body)], text...)
+		case p.isTextHTML() && html != "":
+			if i := bytes.LastIndex(bytes.ToLower(p.body), []byte("</body>")); i > -1 {
+				b := make([]byte, 0, len(p.body)+len(html))
+				b = append(append(append(b, p.body[:i]...), html...), p.body[i:]...)
+				p.body = b
+			} else {
+				p.body = append(p.body[:len(p.body):len(p.body)], html...)
+			}
+		}
+		np[i] = p
+	}
+	return np
+}
+
+// withCharset sets the charset on all text parts in p.
+func withCharset(fun, charset string, p bodyPart) bodyPart {
+	charset = strings.ToLower(charset)
+	if _, ok := Charsets[charset]; !ok {
+		p.err = fmt.Errorf("blackmail.%s: unsupported charset %q", fun, charset)
+		return p
+	}
+	if p.isText() {
+		p.charset = charset
+	}
+	for i := range p.parts {
+		if p.parts[i].isText() {
+			p.parts[i].charset = charset
+		}
+	}
+	return p
+}
+
+// transcode converts the body of text parts with a charset from UTF-8.
+func transcode(parts []bodyPart) ([]bodyPart, error) {
+	np := make([]bodyPart, len(parts))
+	for i, p := range parts {
+		if p.isMultipart() {
+			pp, err := transcode(p.parts)
+			if err != nil {
+				return nil, err
+			}
+			p.parts = pp
+		}
+		if p.isText() && p.charset != "" && p.charset != "utf-8" {
+			b, err := Charsets[p.charset](p.body)
+			if err != nil {
+				return nil, fmt.Errorf("converting %s part to %s: %w", p.ct, p.charset, err)
+			}
+			p.body = b
+		}
+		np[i] = p
+	}
+	return np, nil
+}
+
+func encodeASCII(b []byte) ([]byte, error) {
+	for i, c := range b {
+		if c > 127 {
+			return nil, fmt.Errorf("non-ASCII byte 0x%02x at position %d", c, i)
+		}
+	}
+	return b, nil
+}
+
+func encodeLatin1(b []byte) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	for i, r := range string(b) {
+		if _, size := utf8.DecodeRune(b[i:]); r == utf8.RuneError && size == 1 {
+			return nil, fmt.Errorf("invalid UTF-8 at position %d", i)
+		}
+		if r > 0xff {
+			return nil, fmt.Errorf("%q at position %d can't be represented in ISO-8859-1", r, i)
+		}
+		out = append(out, byte(r))
+	}
+	return out, nil
+}
+
+// replaceText replaces strings in all text parts.
+func replaceText(parts []bodyPart, r *strings.Replacer) []bodyPart {
+	np := make([]bodyPart, len(parts))
+	for i, p := range parts {
+		switch {
+		case p.attach || p.inlineAttach:
+		case p.isMultipart():
+			p.parts = replaceText(p.parts, r)
+		case p.isText():
+			p.body = []byte(r.Replace(string(p.body)))
+		}
+		np[i] = p
+	}
+	return np
+}
+
+// sortParts sorts the parts and the parts of any multipart in place.
+func sortParts(parts []bodyPart, less func(a, b bodyPart) bool) {
+	for i := range parts {
+		if parts[i].isMultipart() {
+			parts[i].parts = append([]bodyPart{}, parts[i].parts...)
+			sortParts(parts[i].parts, less)
+		}
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return less(parts[i], parts[j]) })
+}
+
+func forceCTE(parts []bodyPart, cte string) []bodyPart {
+	np := make([]bodyPart, len(parts))
+	for i, p := range parts {
+		switch {
+		case p.isMultipart():
+			p.parts = forceCTE(p.parts, cte)
+		case p.cte == "" && p.ct != "application/pgp-signature":
+			p.cte = cte
+		}
+		np[i] = p
+	}
+	return np
+}
+
+// parseEML reads the message from r, applying the overrides, and returns the
+// arguments for Message().
+func parseEML(r io.Reader, overrides []bodyPart) (string, mail.Address, []recipient, []bodyPart, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", mail.Address{}, nil, nil, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return "", mail.Address{}, nil, nil, err
+	}
+
+	// Apply the overrides; the first header with a name replaces all headers
+	// with that name in the message, and later ones are added.
+	var (
+		h     = textproto.MIMEHeader(m.Header)
+		set   = make(map[string]bool)
+		parts []bodyPart
+		opts  []bodyPart
+	)
+	for _, p := range overrides {
+		switch p.ct {
+		case "HEADERS":
+			for i := 0; i < len(p.headers); i += 2 {
+				k := textproto.CanonicalMIMEHeaderKey(p.headers[i])
+				if !set[k] {
+					h.Del(k)
+					set[k] = true
+				}
+				h.Add(k, p.headers[i+1])
+			}
+		case "OPTION":
+			opts = append(opts, p)
+		default:
+			if p.err != nil {
+				opts = append(opts, p) // Let Message() report it.
+				continue
+			}
+			parts = append(parts, p)
+		}
+	}
+
+	from, err := mail.Header(h).AddressList("From")
+	if err != nil {
+		return "", mail.Address{}, nil, nil, fmt.Errorf("From header: %w", err)
+	}
+	if len(from) != 1 {
+		return "", mail.Address{}, nil, nil, fmt.Errorf("need exactly one From address, not %d", len(from))
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		return "", mail.Address{}, nil, nil, fmt.Errorf("Subject header: %w", err)
+	}
+	var rcpt []recipient
+	for _, k := range []string{"To", "Cc", "Bcc"} {
+		addr, err := mail.Header(h).AddressList(k)
+		if err != nil && err != mail.ErrHeaderNotPresent {
+			return "", mail.Address{}, nil, nil, fmt.Errorf("%s header: %w", k, err)
+		}
+		for _, a := range addr {
+			rcpt = append(rcpt, recipient{kind: strings.ToLower(k), Address: *a})
+		}
+	}
+
+	if len(parts) == 0 {
+		p, err := parseEMLPart(h, m.Body)
+		if err != nil {
+			return "", mail.Address{}, nil, nil, err
+		}
+		parts = []bodyPart{p}
+	}
+
+	// Copy the remaining headers, in the same order as the message.
+	for _, k := range []string{"From", "To", "Cc", "Bcc", "Subject", "Mime-Version",
+		"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"} {
+		h.Del(k)
+	}
+	if !set["Date"] {
+		h.Del("Date")
+	}
+	if !set["Message-Id"] {
+		h.Del("Message-Id")
+	}
+	var hdr []string
+	for _, k := range headerOrder(b, h) {
+		for _, v := range h[k] {
+			hdr = append(hdr, k, v)
+		}
+	}
+	if len(hdr) > 0 {
+		parts = append(parts, Headers(hdr...))
+	}
+	return subject, *from[0], rcpt, append(parts, opts...), nil
+}
+
+// headerOrder gets the keys of h in the order they appear in the header of msg;
+// any keys that don't appear are added at the end, sorted.
+func headerOrder(msg []byte, h textproto.MIMEHeader) []string {
+	var (
+		keys = make([]string, 0, len(h))
+		seen = make(map[string]bool)
+	)
+	for _, line := range strings.Split(string(msg), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		k, _, ok := strings.Cut(line, ":")
+		if !ok || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		k = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k))
+		if _, ok := h[k]; ok && !seen[k] {
+			keys, seen[k] = append(keys, k), true
+		}
+	}
+
+	var rest []string
+	for k := range h {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// parseEMLPart converts a MIME part to a bodyPart.
+func parseEMLPart(h textproto.MIMEHeader, body io.Reader) (bodyPart, error) {
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if h.Get("Content-Type") == "" {
+		mt, params, err = "text/plain", nil, nil
+	}
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) { // Still returns the type.
+		return bodyPart{}, fmt.Errorf("Content-Type: %w", err)
+	}
+
+	if strings.HasPrefix(mt, "multipart/") {
+		p := bodyPart{ct: mt}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			mp, err := mr.NextRawPart()
+			if err == io.EOF {
+				return p, nil
+			}
+			if err != nil {
+				return bodyPart{}, err
+			}
+			sub, err := parseEMLPart(mp.Header, mp)
+			if err != nil {
+				return bodyPart{}, err
+			}
+			p.parts = append(p.parts, sub)
+		}
+	}
+
+	if cs := strings.ToLower(params["charset"]); strings.HasPrefix(mt, "text/") &&
+		cs != "" && cs != "utf-8" && cs != "us-ascii" {
+		return bodyPart{}, fmt.Errorf("unsupported charset %q for %s part", cs, mt)
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body) // Ignores CRLF.
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return bodyPart{}, fmt.Errorf("reading %s part: %w", mt, err)
+	}
+
+	p := bodyPart{ct: mt, body: b}
+	if cid := strings.Trim(h.Get("Content-Id"), "<> "); cid != "" {
+		p.cid, p.cidSet = cid, true
+	}
+	disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	switch disp {
+	case "attachment":
+		p.attach, p.filename = true, dparams["filename"]
+	case "inline":
+		// Text parts are sometimes marked as inline too.
+		if !p.isText() || dparams["filename"] != "" {
+			p.inlineAttach, p.filename = true, dparams["filename"]
 		}
 	}
-	w.Write([]byte("\r\n"))
+	return p, nil
 }
 
-func attach(ct, fn string, body []byte) (string, string, string) {
+// msgID normalizes a Message-Id to the "<id>" form.
+func msgID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return ""
+	}
+	return "<" + strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">") + ">"
+}
+
+// quoteLines splits text in to lines for quoting, removing any trailing blank
+// lines.
+func quoteLines(text []byte) []string {
+	t := strings.ReplaceAll(string(text), "\r\n", "\n")
+	lines := strings.Split(t, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// envelope gets the envelope recipients: all To, Cc, and Bcc addresses, and
+// the From address with BccSelf(). Duplicates are removed.
+func envelope(from mail.Address, rcpt []recipient, opts msgOpts) ([]string, error) {
+	addr := make([]mail.Address, 0, len(rcpt)+1)
+	for _, r := range rcpt {
+		if r.err != nil {
+			return nil, fmt.Errorf("blackmail.Message: %w", r.err)
+		}
+		if r.kind != "to" && r.kind != "cc" && r.kind != "bcc" {
+			return nil, fmt.Errorf("blackmail.Message: unknown recipient type: %q", r.kind)
+		}
+		addr = append(addr, r.Address)
+	}
+	if opts.bccSelf {
+		addr = append(addr, from)
+	}
+
+	addr = uniqAddr(addr)
+	to := make([]string, len(addr))
+	for i := range addr {
+		to[i] = addr[i].Address
+	}
+	return to, nil
+}
+
+// uniqAddr removes duplicate addresses, keeping the first one.
+func uniqAddr(addr []mail.Address) []mail.Address {
+	var (
+		seen = make(map[string]struct{})
+		u    = make([]mail.Address, 0, len(addr))
+	)
+	for _, a := range addr {
+		k := strings.ToLower(a.Address)
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		u = append(u, a)
+	}
+	return u
+}
+
+// listURLs formats a list of URLs for the List-* headers.
+func listURLs(urls []string) string {
+	if len(urls) == 1 && urls[0] == "NO" { // List-Post: NO
+		return urls[0]
+	}
+	b := new(strings.Builder)
+	for i, u := range urls {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		u = strings.TrimSpace(u)
+		if !strings.HasPrefix(u, "<") {
+			u = "<" + u + ">"
+		}
+		b.WriteString(u)
+	}
+	return b.String()
+}
+
+// checkUnsubscribe checks if all URLs are valid for List-Unsubscribe.
+func checkUnsubscribe(urls []string, oneClick bool) error {
+	if len(urls) == 0 {
+		return errors.New("need at least one URL")
+	}
+	https := false
+	for _, u := range urls {
+		u = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(u), "<"), ">")
+		p, err := url.Parse(u)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(p.Scheme) {
+		case "https":
+			https = true
+			fallthrough
+		case "http":
+			if p.Host == "" {
+				return fmt.Errorf("no host in %q", u)
+			}
+		case "mailto":
+			if p.Opaque == "" {
+				return fmt.Errorf("no address in %q", u)
+			}
+		default:
+			return fmt.Errorf("not a mailto: or http(s): URL: %q", u)
+		}
+	}
+	if oneClick && !https {
+		return errors.New("one-click unsubscribe needs a https: URL")
+	}
+	return nil
+}
+
+func attach(ct, fn string, body []byte) (string, string, string, error) {
 	h := fnv.New32a()
 	h.Write(body)
-	n := h.Sum32()
-	cid := fmt.Sprintf("%s-%s-%s@blackmail",
+	ct, fn = attachType(ct, fn, body)
+	cid, err := attachCID(h.Sum32())
+	return ct, fn, cid, err
+}
+
+// attachReader is like attach(), but for attachments read from an io.Reader.
+// We can't hash the body or sniff the content type, so the CID is based on the
+// filename and the type is based on the extension only; it's an error if
+// there's no type and the extension isn't known.
+func attachReader(ct, fn string) (string, string, string, error) {
+	if ct == "" && mime.TypeByExtension(filepath.Ext(fn)) == "" {
+		return "", "", "", fmt.Errorf(
+			"blackmail.AttachmentReader: can't determine Content-Type for %q; set it explicitly", fn)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(fn))
+	ct, fn = attachType(ct, fn, nil)
+	cid, err := attachCID(h.Sum32())
+	return ct, fn, cid, err
+}
+
+func attachCID(hash uint32) (string, error) {
+	r, err := testRandom()
+	if err != nil {
+		return "", fmt.Errorf("creating Content-Id: %w", err)
+	}
+	return fmt.Sprintf("%s-%s-%s@blackmail",
 		now().UTC().Format("20060102150405.0000"),
-		strconv.FormatUint(uint64(n), 36),
-		strconv.FormatUint(testRandom(), 36))
+		strconv.FormatUint(uint64(hash), 36),
+		strconv.FormatUint(r, 36)), nil
+}
 
+// attachType guesses the content type from the filename extension or the body,
+// and the filename from the content type. The body isn't used if it's nil.
+func attachType(ct, fn string, body []byte) (string, string) {
 	switch {
 	case fn == "" && ct == "":
-		return "data", "application/octet-stream", cid
+		return "application/octet-stream", "data"
 	case ct == "" && fn != "":
-		ct = mime.TypeByExtension(fn)
-		if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(fn))
+		if ct == "" && body != nil {
 			ct = http.DetectContentType(body)
 		}
 		if ct == "" {
@@ -440,6 +1459,5 @@ func attach(ct, fn string, body []byte) (string, string, string) {
 			fn = "attachment" + exts[0]
 		}
 	}
-
-	return ct, fn, cid
+	return ct, fn
 }
@@ -2,14 +2,21 @@ package blackmail
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/mail"
+	"net/textproto"
 	"os"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"zgo.at/blackmail/internal/ztest"
@@ -60,6 +67,24 @@ func TestMessage(t *testing.T) {
 				Bodyf("Newsletter"))
 		}, []string{"bcc@bcc.bcc", "x@x.x"}},
 
+		// Set Reply-To; duplicates are removed.
+		{"reply-to", func() ([]byte, []string, error) {
+			return Message("Reply-To", From("", "me@example.com"),
+				To("to@to.to"),
+				ReplyTo(From("Support, Inc.", "support@example.com")),
+				ReplyToNames("", "sales@example.com", "Support", "SUPPORT@example.com"),
+				Bodyf("Hello=there"))
+		}, []string{"to@to.to"}},
+
+		// Reply-To from Headers() takes precedence.
+		{"reply-to-headers", func() ([]byte, []string, error) {
+			return Message("Reply-To", From("", "me@example.com"),
+				To("to@to.to"),
+				ReplyTo(From("Support, Inc.", "support@example.com")),
+				Headers("Reply-To", "<other@example.com>"),
+				Bodyf("Hello=there"))
+		}, []string{"to@to.to"}},
+
 		// Set your own headers.
 		{"headers", func() ([]byte, []string, error) {
 			return Message("Custom headers", From("", "me@example.com"),
@@ -82,6 +107,23 @@ func TestMessage(t *testing.T) {
 				BodyHTML([]byte("<b>html</b> <")))
 		}, []string{"to@to.to"}},
 
+		// Same, but with the MessageHTML() shortcut.
+		{"alternative", func() ([]byte, []string, error) {
+			return MessageHTML("text and html", From("", "me@example.com"),
+				To("to@to.to"),
+				[]byte("<b>text</b> <"),
+				[]byte("<b>html</b> <"))
+		}, []string{"to@to.to"}},
+
+		// X-Original-Size header with the size of all parts.
+		{"original-size", func() ([]byte, []string, error) {
+			return Message("text and html", From("", "me@example.com"),
+				To("to@to.to"),
+				HeadersOriginalSize(),
+				BodyText([]byte("<b>text</b> <")),
+				BodyHTML([]byte("<b>html</b> <")))
+		}, []string{"to@to.to"}},
+
 		// Attachments.
 		{"attachment", func() ([]byte, []string, error) {
 			return Message("Attachment", From("", "me@example.com"),
@@ -131,7 +173,6 @@ func TestMessage(t *testing.T) {
 		// - Sets header to indicate this is an autoreply.
 		// - Adds a HTML part with an inline image.
 		// - Sets In-Reply-To and List-Id
-		// - Adds a quoted previous part ← TODO: need to add API for this.
 		{"headers-autoreply", func() ([]byte, []string, error) {
 			return Message("Re: autoreply", From("", "me@example.com"),
 				append(ToNames("Customer", "cust@example.com"), CcAddress(mail.Address{Address: "x@x.x"})...),
@@ -143,10 +184,54 @@ func TestMessage(t *testing.T) {
 					[]byte(`<b>Auto respond</b><br><img src="cid:blackmail:1"`),
 					InlineImage("", "logo.png", image.PNG)))
 		}, []string{"cust@example.com", "x@x.x"}},
+
+		{"inline-attachment", func() ([]byte, []string, error) {
+			return Message("Inline images and attachment", From("", "me@example.com"), To("to@to.to"),
+				BodyText([]byte("Hello")),
+				BodyHTML([]byte(`<img src="cid:blackmail:1"> <img src="cid:blackmail:2">`),
+					InlineImage("image/png", "a.png", image.PNG),
+					InlineImage("image/gif", "a.gif", image.GIF)),
+				Attachment("application/pdf", "a.pdf", []byte("%PDF-1.4")))
+		}, []string{"to@to.to"}},
+
+		// Explicit Content-IDs, mixed with a numbered one.
+		{"inline-image-cid", func() ([]byte, []string, error) {
+			return Message("Inline image with cid", From("", "me@example.com"), To("to@to.to"),
+				BodyText([]byte("Hello")),
+				BodyHTML([]byte(`<img src="cid:logo@example.com"> <img src="cid:blackmail:1"> <img src="cid:banner">`),
+					InlineImageCID("image/png", "logo.png", "<logo@example.com>", image.PNG),
+					InlineImage("image/gif", "a.gif", image.GIF),
+					InlineImageCID("image/jpeg", "banner.jpeg", "banner", image.JPEG)))
+		}, []string{"to@to.to"}},
+
+		{"charset", func() ([]byte, []string, error) {
+			return Message("Charset", From("", "me@example.com"), To("to@to.to"),
+				BodyTextCharset("ISO-8859-1", []byte("Héllo wörld")),
+				BodyHTMLCharset("iso-8859-1", []byte("<p>Héllo wörld</p>")))
+		}, []string{"to@to.to"}},
+
+		// Load from .eml template.
+		{"from-eml", func() ([]byte, []string, error) {
+			fp, err := os.Open("testdata/welcome-template.eml")
+			if err != nil {
+				return nil, nil, err
+			}
+			defer fp.Close()
+			return MessageFromEML(fp,
+				Headers("Subject", "Welcome aboard, {{name}}!", "To", "Martin <martin@example.com>"),
+				Replace("{{name}}", "Martin"))
+		}, []string{"martin@example.com", "support@example.com"}},
+
+		{"quote", func() ([]byte, []string, error) {
+			prev := []byte("Hello,\r\n\r\n> Earlier <quote>\r\nThanks\r\n\r\n\r\n")
+			return Message("Re: quote", From("", "me@example.com"), To("to@to.to"),
+				BodyText(append([]byte("Thanks for your email!\n\n"), BodyQuote(prev).body...)),
+				BodyHTML(append([]byte("<p>Thanks for your email!</p>\n"), BodyQuoteHTML(prev).body...)))
+		}, []string{"to@to.to"}},
 	}
 
 	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 123456789, time.UTC) }
-	testRandom = func() uint64 { return 42 }
+	testRandom = func() (uint64, error) { return 42, nil }
 	testBoundary = "XXX"
 
 	for _, tt := range tests {
@@ -192,6 +277,18 @@ func TestMessageError(t *testing.T) {
 				To("to@to.to"),
 				Headers(""))
 		}},
+
+		{"blackmail.Message: blackmail.CcNames: odd argument count", func() ([]byte, []string, error) {
+			return Message("Recipients", From("", "me@example.com"),
+				append(To("to@to.to"), CcNames("Name")...),
+				Bodyf("Hello"))
+		}},
+
+		{`blackmail.Message: unknown recipient type: "x"`, func() ([]byte, []string, error) {
+			return Message("Recipients", From("", "me@example.com"),
+				[]recipient{{kind: "x", Address: mail.Address{Address: "x@x.x"}}},
+				Bodyf("Hello"))
+		}},
 	}
 
 	for i, tt := range tests {
@@ -223,10 +320,1199 @@ func BenchmarkMIME(b *testing.B) {
 	}
 }
 
+func TestEncodeH(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Hello, world", "Hello, world"},
+		{"tab\there", "tab\there"},
+		{"Ünïcödé", "=?utf-8?q?=C3=9Cn=C3=AFc=C3=B6d=C3=A9?="},
+		{"bell\x07", "=?utf-8?q?bell=07?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := encodeH(tt.in); got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteH(b *testing.B) {
+	for _, v := range []string{"An ASCII subject line", "Ünïcödé subject"} {
+		b.Run(v, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				writeH(io.Discard, nil, "Subject", v)
+			}
+		})
+	}
+}
+
 func BenchmarkBase64(b *testing.B) {
 	b.ReportAllocs()
-	w := wrappedBase64{new(bytes.Buffer)}
+	w := newBase64Writer(new(bytes.Buffer), 76)
 	for n := 0; n < b.N; n++ {
 		w.Write(image.JPEG)
 	}
+	w.Close()
+}
+
+func TestType(t *testing.T) {
+	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 123456789, time.UTC) }
+	testRandom = func() (uint64, error) { return 42, nil }
+	testBoundary = "XXX"
+
+	msg, _, err := Message("Type", From("", "me@example.com"),
+		To("to@to.to"),
+		Bodyf("Report attached"),
+		Attachment("", "report.bin", []byte("%PDF-1.4")).Type("application/pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "Content-Type: application/pdf; name=\"report.bin\"\r\n") {
+		t.Errorf("Content-Type not overridden:\n%s", msg)
+	}
+
+	_, _, err = Message("Type", From("", "me@example.com"),
+		To("to@to.to"),
+		Bodyf("Report attached"),
+		HeadersAutoreply().Type("text/plain"))
+	if !ztest.ErrorContains(err, "can't set Content-Type") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// spaceEncoder encodes all spaces and tabs, rather than just trailing ones.
+type spaceEncoder struct{ w io.Writer }
+
+func (e spaceEncoder) Close() error { return nil }
+func (e spaceEncoder) Write(p []byte) (int, error) {
+	r := strings.NewReplacer(" ", "=20", "\t", "=09", "=", "=3D")
+	_, err := io.WriteString(e.w, r.Replace(string(p)))
+	return len(p), err
+}
+
+func TestEncoder(t *testing.T) {
+	body := []byte("Trailing  \r\nspace\t\r\n")
+	tests := []struct {
+		in   bodyPart
+		want string
+	}{
+		{BodyText(body), "\r\n\r\nTrailing =20\r\nspace=09\r\n"},
+		{BodyText(body).Encoder(func(w io.Writer) io.WriteCloser { return spaceEncoder{w} }),
+			"\r\n\r\nTrailing=20=20\r\nspace=09\r\n"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			msg, _, err := Message("Encoder", From("", "me@example.com"), To("to@to.to"), tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(string(msg), tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", msg, tt.want)
+			}
+		})
+	}
+
+	_, _, err := Message("Encoder", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("x"), Attachment("image/png", "x.png", image.PNG).Encoder(nil))
+	if !ztest.ErrorContains(err, "can't set encoder") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	tests := []struct {
+		in      bodyPart
+		want    string
+		wantErr string
+	}{
+		{BodyText([]byte("Hello\r\n")).TransferEncoding("7bit"),
+			"Content-Transfer-Encoding: 7bit\r\n\r\nHello\r\n", ""},
+		{BodyText([]byte("Héllo\r\n")).TransferEncoding("8BIT"),
+			"Content-Transfer-Encoding: 8bit\r\n\r\nHéllo\r\n", ""},
+		{BodyText([]byte("Héllo\r\n")).TransferEncoding("binary"),
+			"Content-Transfer-Encoding: binary\r\n\r\nHéllo\r\n", ""},
+		{BodyText([]byte("Héllo")).TransferEncoding("base64"),
+			"Content-Transfer-Encoding: base64\r\n\r\nSMOpbGxv\r\n", ""},
+		{Body("application/json", []byte(`{"a":"é"}`)).TransferEncoding("quoted-printable"),
+			"Content-Type: application/json\r\n\r\n{\"a\":\"=C3=A9\"}\r\n", ""},
+
+		{BodyText([]byte("Héllo")).TransferEncoding("7bit"), "", "text/plain part has 7bit encoding but contains byte 0xc3 at position 1"},
+		{BodyText([]byte("Héllo\nwörld\n")).TransferEncoding("8bit"),
+			"Content-Transfer-Encoding: 8bit\r\n\r\nHéllo\r\nwörld\r\n", ""},
+		{BodyText([]byte("Héllo\r")).TransferEncoding("8bit"), "", "text/plain part has 8bit encoding but contains bare CR at position 6"},
+		{BodyText([]byte("Hello")).TransferEncoding("x-uuencode"), "", `blackmail.TransferEncoding: unknown encoding "x-uuencode"`},
+		{BodyHTML([]byte("Hello"), InlineImage("", "a.png", image.PNG)).TransferEncoding("7bit"), "",
+			`blackmail.TransferEncoding: can't set transfer encoding on "multipart/related" part`},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			msg, _, err := Message("Encoding", From("", "me@example.com"), To("to@to.to"), tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if !strings.Contains(string(msg), tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", msg, tt.want)
+			}
+		})
+	}
+}
+
+func TestForceEncoding(t *testing.T) {
+	sig := []byte("-----BEGIN PGP SIGNATURE-----\r\n\r\niHUEARYKAB0WIQTs\r\n-----END PGP SIGNATURE-----\r\n")
+	for _, enc := range []string{"base64", "Quoted-Printable"} {
+		t.Run(enc, func(t *testing.T) {
+			msg, _, err := Message("Encoding", From("", "me@example.com"), To("to@to.to"),
+				BodyText([]byte("Hello")),
+				BodyHTML([]byte("<p>Hello</p>"), InlineImage("", "a.png", image.PNG)),
+				Attachment("", "x.csv", []byte("a,b\n")),
+				Body("application/pgp-signature", sig),
+				ForceEncoding(enc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := mail.ReadMessage(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err = walkParts(textproto.MIMEHeader(m.Header), m.Body, func(h textproto.MIMEHeader, _ []byte) {
+				got = append(got, h.Get("Content-Transfer-Encoding"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{strings.ToLower(enc), strings.ToLower(enc), strings.ToLower(enc), strings.ToLower(enc), "7bit"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got, want)
+			}
+		})
+	}
+
+	_, _, err := Message("Encoding", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), ForceEncoding("8bit"))
+	if !ztest.ErrorContains(err, `blackmail.ForceEncoding: encoding must be base64 or quoted-printable, not "8bit"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestPartOrder(t *testing.T) {
+	calLast := func(a, b bodyPart) bool {
+		if a.ContentType() == "text/calendar" || b.ContentType() == "text/calendar" {
+			return b.ContentType() == "text/calendar" && a.ContentType() != "text/calendar"
+		}
+		return a.Filename() < b.Filename()
+	}
+
+	msg, _, err := Message("Order", From("", "me@example.com"), To("to@to.to"),
+		Body("text/calendar", []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")),
+		BodyText([]byte("Hello")),
+		Attachment("", "z.csv", []byte("z")),
+		Attachment("", "a.csv", []byte("a")),
+		PartOrder(calLast))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = walkParts(textproto.MIMEHeader(m.Header), m.Body, func(h textproto.MIMEHeader, _ []byte) {
+		got = append(got, strings.TrimSpace(strings.Split(h.Get("Content-Type"), ";")[0])+" "+fname(h))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"text/plain ", "text/csv a.csv", "text/csv z.csv", "text/calendar "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestCheck7bit(t *testing.T) {
+	sig := "-----BEGIN PGP SIGNATURE-----\r\n\r\niHUEARYKAB0WIQTs\r\n=7nLx\r\n-----END PGP SIGNATURE-----\r\n"
+	tests := []struct {
+		in      []byte
+		wantErr string
+	}{
+		{[]byte(sig), ""},
+		{[]byte(strings.ReplaceAll(sig, "\r\n", "\n")), ""},
+		{[]byte("-----BEGIN PGP SIGNATURE-----\r\n€\r\n"), "contains byte 0xe2 at position 31"},
+		{[]byte("-----BEGIN PGP SIGNATURE-----\n\x00"), "contains byte 0x00 at position 31"},
+		{[]byte("-----BEGIN PGP SIGNATURE-----\r"), "bare CR at position 29"},
+		{[]byte(strings.Repeat("x", 998) + "\r\n"), ""},
+		{[]byte(strings.Repeat("x", 999) + "\r\n"), "line longer than 998 characters"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			_, _, err := Message("7bit", From("", "me@example.com"), To("to@to.to"),
+				Bodyf("Signed"), Body("application/pgp-signature", tt.in))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("LF", func(t *testing.T) {
+		in := []byte(strings.ReplaceAll(sig, "\r\n", "\n"))
+		msg, _, err := Message("7bit", From("", "me@example.com"), To("to@to.to"),
+			Bodyf("Signed"), Body("application/pgp-signature", in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(msg), sig) {
+			t.Errorf("signature not converted to CRLF:\n%s", msg)
+		}
+		if string(in) != strings.ReplaceAll(sig, "\r\n", "\n") {
+			t.Errorf("input was modified")
+		}
+	})
+}
+
+func TestFromParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    mail.Address
+		wantErr string
+	}{
+		{"Alice <alice@example.com>", From("Alice", "alice@example.com"), ""},
+		{`"Smith, Alice" <alice@example.com>`, From("Smith, Alice", "alice@example.com"), ""},
+		{"alice@example.com", From("", "alice@example.com"), ""},
+		{"Alice", mail.Address{}, `blackmail.FromParse: "Alice": mail: `},
+		{"", mail.Address{}, `blackmail.FromParse: "": mail: `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := FromParse(tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("\ngot:  %#v\nwant: %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []recipient
+		wantErr string
+	}{
+		{"Alice <alice@example.com>, bob@example.com", append(
+			ToNames("Alice", "alice@example.com"), To("bob@example.com")...), ""},
+		{`"Smith, Alice" <alice@example.com>,"Bob" <bob@example.com>`,
+			ToNames("Smith, Alice", "alice@example.com", "Bob", "bob@example.com"), ""},
+		{"alice@example.com, Bob", nil, `blackmail.Message: blackmail.ToParse: "alice@example.com, Bob": mail: `},
+		{"", nil, `blackmail.Message: blackmail.ToParse: "": mail: `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := ToParse(tt.in)
+			_, _, err := Message("Subject", From("", "me@example.com"), got, Bodyf("Hello"))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %#v\nwant: %#v", got, tt.want)
+			}
+		})
+	}
+
+	got := append(CcParse("a@example.com"), BccParse("b@example.com")...)
+	if want := append(Cc("a@example.com"), Bcc("b@example.com")...); !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestDateHeader(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{"2024-01-02T15:04:05Z", "Tue, 02 Jan 2024 15:04:05 +0000", ""},
+		{"2024-01-02T15:04:05+02:00", "Tue, 02 Jan 2024 15:04:05 +0200", ""},
+		{"Tue, 02 Jan 2024 15:04:05 +0200", "Tue, 02 Jan 2024 15:04:05 +0200", ""},
+		{"2 Jan 2024 15:04 -0700", "Tue, 02 Jan 2024 15:04:00 -0700", ""},
+		{"yesterday", "", `blackmail.Message: invalid Date header "yesterday"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			msg, _, err := Message("Date", From("", "me@example.com"), To("to@to.to"),
+				Bodyf("Hello"), Headers("date", tt.in))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			m, err := mail.ReadMessage(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Header["Date"]; len(got) != 1 || got[0] != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+			if _, err := time.Parse(time.RFC1123Z, m.Header.Get("Date")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAttachPGPKey(t *testing.T) {
+	key := "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmDMEZbJ7ARYJKwYBBAHaRw8BAQdA\n=iT7q\n-----END PGP PUBLIC KEY BLOCK-----\n"
+
+	m, _, err := Message("Key", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Key attached"), AttachPGPKey([]byte(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Content-Transfer-Encoding: 7bit\r\nContent-Type: application/pgp-keys\r\n"
+	if !strings.Contains(string(m), want) {
+		t.Errorf("wrong headers:\n%s", m)
+	}
+	if want := "\r\n\r\n" + ztest.CRLF(key); !strings.Contains(string(m), want) {
+		t.Errorf("key not in message:\n%s", m)
+	}
+
+	_, _, err = Message("Key", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Key attached"), AttachPGPKey([]byte("not a key")))
+	if want := "blackmail.AttachPGPKey: not an ASCII-armored public key"; !ztest.ErrorContains(err, want) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestPlusAddress(t *testing.T) {
+	tests := []struct {
+		base, tag, want, wantErr string
+	}{
+		{"support@example.com", "ticket123", "support+ticket123@example.com", ""},
+		{"support+old@example.com", "new", "support+new@example.com", ""},
+		{"support@example.com", "a.b-c_d", "support+a.b-c_d@example.com", ""},
+		{"support@example.com", "x@y", "", `invalid tag "x@y"`},
+		{"support@example.com", "a b", "", `invalid tag "a b"`},
+		{"support@example.com", "", "", `invalid tag ""`},
+		{"support", "x", "", `no @ in "support"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.base+"/"+tt.tag, func(t *testing.T) {
+			got, err := PlusAddress(tt.base, tt.tag)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+
+	addr, _ := PlusAddress("support@example.com", "ticket123")
+	msg, _, err := Message("Plus", From("", "support@example.com"), To("to@to.to"),
+		Bodyf("Hello"), ReplyToNames("Support", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "Reply-To: \"Support\" <support+ticket123@example.com>\r\n") {
+		t.Errorf("no Reply-To in message:\n%s", msg)
+	}
+
+	_, _, err = Message("Plus", From("", "support@example.com"), To("to@to.to"),
+		Bodyf("Hello"), ReplyToNames("Support", "x@y@example.com"))
+	if !ztest.ErrorContains(err, "blackmail.ReplyTo") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestMessageErrors(t *testing.T) {
+	_, _, err := Message("Errors", From("", "me@example.com"), nil, Bodyf("Hello"))
+	if !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, _, err = Message("Errors", From("", "me@example.com"), nil, Bodyf("Hello"), BccSelf())
+	if err != nil {
+		t.Errorf("BccSelf without recipients: %v", err)
+	}
+
+	_, _, err = Message("Errors", From("", "me@example.com"), To("to@to.to"), Headers("X-A", "a"))
+	if !errors.Is(err, ErrNoBody) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	_, _, err = Message("Errors", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), Headers("X-A"))
+	var pErr PartError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if pErr.Index != 2 {
+		t.Errorf("wrong index: %d", pErr.Index)
+	}
+	if want := "blackmail.Message part 2: blackmail.Headers: odd argument count"; err.Error() != want {
+		t.Errorf("\ngot:  %s\nwant: %s", err, want)
+	}
+
+	// Errors in subparts.
+	_, _, err = Message("Errors", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), BodyHTML([]byte("<img>"), InlineImageCID("image/png", "a.png", "a b", image.PNG)))
+	if want := `blackmail.Message part 2: blackmail.InlineImageCID: invalid Content-ID: "a b"`; !ztest.ErrorContains(err, want) {
+		t.Errorf("\ngot:  %s\nwant: %s", err, want)
+	}
+}
+
+func TestDuplicateCID(t *testing.T) {
+	_, _, err := Message("CID", From("", "me@example.com"), To("to@to.to"),
+		BodyHTML([]byte(`<img src="cid:logo">`),
+			InlineImageCID("image/png", "a.png", "logo", image.PNG),
+			InlineImageCID("image/gif", "a.gif", "<logo>", image.GIF)))
+	if want := `blackmail.Message: duplicate Content-ID "logo"`; !ztest.ErrorContains(err, want) {
+		t.Errorf("\ngot:  %v\nwant: %s", err, want)
+	}
+
+	// Generated from the same content, time, and random number.
+	defer func() {
+		now = func() time.Time { return time.Now() }
+		testRandom = randomID
+	}()
+	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 0, time.UTC) }
+	testRandom = func() (uint64, error) { return 42, nil }
+	_, _, err = Message("CID", From("", "me@example.com"), To("to@to.to"),
+		BodyHTML([]byte(`<img src="cid:blackmail:1"><img src="cid:blackmail:2">`),
+			InlineImage("image/png", "a.png", image.PNG),
+			InlineImage("image/png", "b.png", image.PNG)))
+	if want := `blackmail.Message: duplicate Content-ID "20190618133700.0000-`; !ztest.ErrorContains(err, want) {
+		t.Errorf("\ngot:  %v\nwant: %s", err, want)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	rcpt := append(To("a@example.com", "b@example.com"), Cc("c@example.com", "A@example.com")...)
+	rcpt = append(rcpt, Bcc("d@example.com", "b@example.com")...)
+	from := From("", "me@example.com")
+
+	got, err := Recipients("Subject", from, rcpt, Bodyf("Hello"), BccSelf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "me@example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:  %q\nwant: %q", got, want)
+	}
+
+	_, to, err := Message("Subject", from, rcpt, Bodyf("Hello"), BccSelf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, to) {
+		t.Errorf("different from Message():\nRecipients: %q\nMessage:    %q", got, to)
+	}
+
+	_, err = Recipients("Subject", from, nil, Bodyf("Hello"))
+	if !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = Recipients("Subject", from, rcpt, Bodyf("Hello"), Headers("X-A"))
+	if !ztest.ErrorContains(err, "blackmail.Message part 2: blackmail.Headers: odd argument count") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestInlineImageRef(t *testing.T) {
+	img, ref := InlineImageRef("image/png", "logo.png", image.PNG)
+	if !strings.HasPrefix(ref, "cid:") {
+		t.Fatalf("wrong ref: %q", ref)
+	}
+
+	m, _, err := Message("Subject", From("", "me@example.com"), To("to@to.to"),
+		BodyHTML([]byte(fmt.Sprintf(`<img src="%s"> <img src="cid:blackmail:1">`, ref)),
+			img, InlineImage("image/gif", "a.gif", image.GIF)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		html string
+		cids = make(map[string]string)
+	)
+	err = walkParts(textproto.MIMEHeader(msg.Header), msg.Body, func(h textproto.MIMEHeader, body []byte) {
+		ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if ct == "text/html" {
+			html = string(body)
+		}
+		if cid := h.Get("Content-Id"); cid != "" {
+			cids[ct] = "cid:" + strings.Trim(cid, "<>")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cids["image/png"] != ref {
+		t.Errorf("Content-Id doesn't match the ref: %q; ref: %q", cids["image/png"], ref)
+	}
+	want := fmt.Sprintf(`<img src="%s"> <img src="%s">`, ref, cids["image/gif"])
+	if html != want {
+		t.Errorf("\ngot:  %s\nwant: %s", html, want)
+	}
+}
+
+func TestMessageFromEML(t *testing.T) {
+	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 123456789, time.UTC) }
+	testRandom = func() (uint64, error) { return 42, nil }
+	testBoundary = "XXX"
+
+	// Messages created by Message() should be identical.
+	for _, f := range []string{"basic", "names", "alternative", "headers", "attachment",
+		"utf8-filenames", "inline-attachment", "inline-image-cid", "headers-autoreply"} {
+		t.Run(f, func(t *testing.T) {
+			want, err := os.ReadFile("testdata/" + f + ".eml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := MessageFromEML(bytes.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := ztest.Diff(string(got), string(want)); d != "" {
+				t.Error(d)
+			}
+		})
+	}
+
+	t.Run("body", func(t *testing.T) {
+		fp, err := os.Open("testdata/welcome-template.eml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		msg, _, err := MessageFromEML(fp, Headers("To", "to@to.to"), Bodyf("Hello {{name}}"), Replace("{{name}}", "Martin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(msg, []byte("\r\n\r\nHello Martin")) || bytes.Contains(msg, []byte("Welcome!")) {
+			t.Errorf("body not replaced:\n%s", msg)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		fp, err := os.Open("testdata/welcome-template.eml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		_, _, err = MessageFromEML(fp)
+		if !ztest.ErrorContains(err, "blackmail.MessageFromEML: To header: mail: ") {
+			t.Errorf("wrong error: %v", err)
+		}
+
+		_, _, err = MessageFromEML(strings.NewReader("From: a@example.com\r\nTo: b@example.com\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\n\r\nH\xe9llo"))
+		if !ztest.ErrorContains(err, `unsupported charset "iso-8859-1" for text/plain part`) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestCharset(t *testing.T) {
+	msg := func(p bodyPart) ([]byte, error) {
+		m, _, err := Message("Charset", From("", "me@example.com"), To("to@to.to"), p)
+		return m, err
+	}
+
+	_, err := msg(BodyTextCharset("x-unknown", []byte("Hello")))
+	if !ztest.ErrorContains(err, `blackmail.BodyTextCharset: unsupported charset "x-unknown"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = msg(BodyTextCharset("iso-8859-1", []byte("Hello €")))
+	if !ztest.ErrorContains(err, `converting text/plain part to iso-8859-1: '€' at position 6 can't be represented in ISO-8859-1`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = msg(BodyTextCharset("us-ascii", []byte("Héllo")))
+	if !ztest.ErrorContains(err, `non-ASCII byte 0xc3 at position 1`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	Charsets["x-upper"] = func(b []byte) ([]byte, error) { return bytes.ToUpper(b), nil }
+	defer delete(Charsets, "x-upper")
+	m, err := msg(BodyTextCharset("X-Upper", []byte("Hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(m, []byte("Content-Type: text/plain; charset=x-upper\r\n")) || !bytes.HasSuffix(m, []byte("\r\nHELLO")) {
+		t.Errorf("wrong message:\n%s", m)
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	t.Run("fold", func(t *testing.T) {
+		long := strings.TrimSpace(strings.Repeat("word ", 300)) // 1499 octets
+		msg, _, err := Message("Long", From("", "me@example.com"), To("to@to.to"),
+			Headers("X-Long", long), Bodyf("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range strings.Split(string(msg), "\r\n") {
+			if len(l) > 78 {
+				t.Errorf("line longer than 78: %q", l)
+			}
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Header.Get("X-Long"); got != long {
+			t.Errorf("header changed after unfolding:\n%q", got)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, _, err := Message("Long", From("", "me@example.com"), To("to@to.to"),
+			Headers("X-Long", strings.Repeat("x", 1500)), Bodyf("Hello"))
+		if !ztest.ErrorContains(err, "longer than the maximum of 998") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("encoder", func(t *testing.T) {
+		nop := func(w io.Writer) io.WriteCloser { return NopCloser(w) }
+		_, _, err := Message("Long", From("", "me@example.com"), To("to@to.to"),
+			BodyText(bytes.Repeat([]byte("x"), 1500)).Encoder(nop))
+		if !ztest.ErrorContains(err, "line 9 is 1500 characters") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestHeadersMailingList(t *testing.T) {
+	tests := []struct {
+		in   ListHeaders
+		want []string
+	}{
+		{ListHeaders{}, nil},
+		{ListHeaders{
+			ID:          "golang-nuts.googlegroups.com",
+			Help:        []string{"https://groups.google.com/g/golang-nuts"},
+			Post:        []string{"mailto:golang-nuts@googlegroups.com"},
+			Unsubscribe: []string{"mailto:golang-nuts+unsubscribe@googlegroups.com", "<https://example.com/unsub>"},
+		}, []string{
+			"List-Id", "<golang-nuts.googlegroups.com>",
+			"List-Help", "<https://groups.google.com/g/golang-nuts>",
+			"List-Unsubscribe", "<mailto:golang-nuts+unsubscribe@googlegroups.com>, <https://example.com/unsub>",
+			"List-Post", "<mailto:golang-nuts@googlegroups.com>",
+		}},
+		{ListHeaders{ID: "Go Nuts <golang-nuts.googlegroups.com>", Post: []string{"NO"}}, []string{
+			"List-Id", "Go Nuts <golang-nuts.googlegroups.com>",
+			"List-Post", "NO",
+		}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			got := HeadersMailingList(tt.in)
+			if got.err != nil {
+				t.Fatal(got.err)
+			}
+			if !reflect.DeepEqual(got.headers, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got.headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestBase64Writer(t *testing.T) {
+	in := bytes.Repeat([]byte("0123456789"), 20)
+	enc := base64.StdEncoding.EncodeToString(in)
+	wrap := func(n int) string {
+		return regexp.MustCompile(fmt.Sprintf(`.{1,%d}`, n)).ReplaceAllString(enc, "$0\r\n")
+	}
+
+	tests := []struct {
+		lineLen, chunk int
+		want           string
+	}{
+		{0, len(in), enc},
+		{0, 7, enc},
+		{76, len(in), wrap(76)},
+		{76, 1, wrap(76)},
+		{76, 57, wrap(76)},
+		{4, 3, wrap(4)},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d-%d", tt.lineLen, tt.chunk), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := newBase64Writer(buf, tt.lineLen)
+			for p := in; len(p) > 0; {
+				n := tt.chunk
+				if n > len(p) {
+					n = len(p)
+				}
+				w.Write(p[:n])
+				p = p[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if buf.String() != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentReader(t *testing.T) {
+	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 123456789, time.UTC) }
+	testRandom = func() (uint64, error) { return 42, nil }
+	testBoundary = "XXX"
+
+	want, _, err := Message("Attachment", From("", "me@example.com"), To("to@to.to"),
+		BodyText([]byte("Look at my images!")),
+		Attachment("", "test.png", image.PNG),
+		Attachment("image/jpeg", "test.jpeg", image.JPEG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := Message("Attachment", From("", "me@example.com"), To("to@to.to"),
+		BodyText([]byte("Look at my images!")),
+		AttachmentReader("", "test.png", iotest.OneByteReader(bytes.NewReader(image.PNG))),
+		AttachmentReader("image/jpeg", "test.jpeg", bytes.NewReader(image.JPEG)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Content-ID is different, as we can't hash the body.
+	cid := regexp.MustCompile(`Content-Id: <.*?>`)
+	if d := ztest.Diff(cid.ReplaceAllString(string(got), ""), cid.ReplaceAllString(string(want), "")); d != "" {
+		t.Error(d)
+	}
+
+	_, _, err = Message("Attachment", From("", "me@example.com"), To("to@to.to"),
+		BodyText([]byte("Look at my images!")),
+		AttachmentReader("", "test.png", iotest.ErrReader(errors.New("oh noes"))))
+	if !ztest.ErrorContains(err, `reading "test.png": oh noes`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	for _, fn := range []string{"", "data", "file.unknown-ext"} {
+		_, _, err = Message("Attachment", From("", "me@example.com"), To("to@to.to"),
+			BodyText([]byte("Look at my images!")),
+			AttachmentReader("", fn, bytes.NewReader(image.PNG)))
+		if !ztest.ErrorContains(err, "can't determine Content-Type") {
+			t.Errorf("%q: wrong error: %v", fn, err)
+		}
+	}
+}
+
+func TestReplaceCIDs(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`<img src="cid:blackmail:1">`, `<img src="cid:one">`},
+		{`<img src='cid:blackmail:2'>`, `<img src='cid:two'>`},
+		{`<img src=cid:blackmail:1>`, `<img src=cid:one>`},
+		{`<img src=cid:blackmail:1/>`, `<img src=cid:one/>`},
+		{`<IMG alt="x" SRC = "cid:blackmail:2" width=1>`, `<IMG alt="x" SRC = "cid:two" width=1>`},
+		{`<img src="cid:blackmail:1"><img src="cid:blackmail:2">`, `<img src="cid:one"><img src="cid:two">`},
+		{`<img src="cid:blackmail:1"`, `<img src="cid:one"`},
+
+		// Not in a tag.
+		{`Use src="cid:blackmail:1" to refer to images`, `Use src="cid:blackmail:1" to refer to images`},
+		{`<p>src="cid:blackmail:1"</p>`, `<p>src="cid:blackmail:1"</p>`},
+
+		// No part for this.
+		{`<img src="cid:blackmail:3">`, `<img src="cid:blackmail:3">`},
+		{`<img src="cid:blackmail:0">`, `<img src="cid:blackmail:0">`},
+		{`<img src="cid:blackmail:10">`, `<img src="cid:blackmail:10">`},
+
+		// Not the entire value or wrong quotes.
+		{`<img src="cid:blackmail:1x">`, `<img src="cid:blackmail:1x">`},
+		{`<img src="cid:blackmail:1'>`, `<img src="cid:blackmail:1'>`},
+		{`<img data-src="cid:blackmail:1">`, `<img data-src="cid:blackmail:1">`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := string(replaceCIDs([]byte(tt.in), []string{"one", "two"}))
+			if got != tt.want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUnsubscribe(t *testing.T) {
+	tests := []struct {
+		in      bodyPart
+		want    []string
+		wantErr string
+	}{
+		{ListUnsubscribe("mailto:unsub@example.com?subject=unsub", "<https://example.com/u/1>"),
+			[]string{"List-Unsubscribe", "<mailto:unsub@example.com?subject=unsub>, <https://example.com/u/1>"}, ""},
+		{ListUnsubscribeOneClick("https://example.com/u/1", "mailto:unsub@example.com"),
+			[]string{
+				"List-Unsubscribe", "<https://example.com/u/1>, <mailto:unsub@example.com>",
+				"List-Unsubscribe-Post", "List-Unsubscribe=One-Click",
+			}, ""},
+		{ListUnsubscribe(), nil, "need at least one URL"},
+		{ListUnsubscribe("unsub@example.com"), nil, `not a mailto: or http(s): URL: "unsub@example.com"`},
+		{ListUnsubscribe("ftp://example.com"), nil, "not a mailto: or http(s): URL"},
+		{ListUnsubscribe("https:///path"), nil, "no host"},
+		{ListUnsubscribe("mailto:"), nil, "no address"},
+		{ListUnsubscribeOneClick("mailto:unsub@example.com", "http://example.com"), nil, "needs a https: URL"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			if !ztest.ErrorContains(tt.in.err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", tt.in.err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.in.headers, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", tt.in.headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeterministicBoundary(t *testing.T) {
+	defer func(b string) { testBoundary = b }(testBoundary)
+	testBoundary = ""
+
+	msg := func(html string, det bool) []byte {
+		t.Helper()
+		parts := []bodyPart{
+			Headers("Message-Id", "<x@example.com>", "Date", "Tue, 18 Jun 2019 13:37:00 +0000"),
+			BodyHTML([]byte(html)),
+		}
+		if det {
+			parts = append(parts, DeterministicBoundary())
+		}
+		m, _, err := Message("Boundary", From("", "me@example.com"), To("to@to.to"),
+			BodyText([]byte("Hello")), parts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	a, b := msg("<p>Hello</p>", true), msg("<p>Hello</p>", true)
+	if !bytes.Equal(a, b) {
+		t.Errorf("not identical:\n%s\n\n%s", a, b)
+	}
+	if c := msg("<p>Hello!</p>", true); bytes.Equal(a[:200], c[:200]) {
+		t.Errorf("same boundary for different content:\n%s\n\n%s", a, c)
+	}
+	if c := msg("<p>Hello</p>", false); bytes.Equal(a, c) {
+		t.Errorf("boundary not random without option")
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	defer func(b string, r func() (uint64, error), s io.Reader) {
+		testBoundary, testRandom, RandSource = b, r, s
+	}(testBoundary, testRandom, RandSource)
+	testBoundary, testRandom = "", randomID
+
+	msg := func() ([]byte, []string, error) {
+		return Message("Rand", From("", "me@example.com"), To("to@to.to"),
+			BodyText([]byte("Hello")), BodyHTML([]byte("<p>Hello</p>")))
+	}
+
+	t.Run("deterministic", func(t *testing.T) {
+		RandSource = bytes.NewReader(bytes.Repeat([]byte{1}, 1024))
+		a, _, err := msg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		RandSource = bytes.NewReader(bytes.Repeat([]byte{1}, 1024))
+		b, _, err := msg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(a, b) {
+			t.Errorf("not identical:\n%s\n\n%s", a, b)
+		}
+	})
+
+	t.Run("short read", func(t *testing.T) {
+		for _, n := range []int{0, 10} {
+			RandSource = bytes.NewReader(bytes.Repeat([]byte{1}, n))
+			_, _, err := msg()
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+				t.Errorf("%d: wrong error: %v", n, err)
+			}
+		}
+	})
+
+	t.Run("attachment", func(t *testing.T) {
+		RandSource = iotest.ErrReader(errors.New("oh noes"))
+		_, _, err := Message("Rand", From("", "me@example.com"), To("to@to.to"),
+			Bodyf("Hello"), Attachment("text/plain", "x.txt", []byte("x")))
+		if !ztest.ErrorContains(err, "oh noes") {
+			t.Errorf("wrong error: %v", err)
+		}
+		var pErr PartError
+		if !errors.As(err, &pErr) || pErr.Index != 2 {
+			t.Errorf("not a PartError for part 2: %#v", err)
+		}
+	})
+}
+
+func TestMessageID(t *testing.T) {
+	send := func(parts ...bodyPart) string {
+		t.Helper()
+		m, _, err := Message("Message-Id", From("", "me@example.com"), To("to@to.to"),
+			Bodyf("Hello"), parts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(m)
+	}
+
+	if m := send(); !strings.Contains(m, "Message-Id: <blackmail-") {
+		t.Errorf("wrong default Message-Id:\n%s", m)
+	}
+	if m := send(MessageID("custom@example.net")); !strings.Contains(m, "Message-Id: <custom@example.net>\r\n") ||
+		strings.Count(m, "Message-Id:") != 1 {
+		t.Errorf("wrong Message-Id:\n%s", m)
+	}
+
+	defer func() { MessageIDFunc = nil }()
+	MessageIDFunc = func(from mail.Address) string { return "uuid-1234@mail.example.org" }
+	if m := send(); !strings.Contains(m, "Message-Id: <uuid-1234@mail.example.org>\r\n") {
+		t.Errorf("wrong Message-Id from MessageIDFunc:\n%s", m)
+	}
+	if m := send(MessageID("<custom@example.net>")); !strings.Contains(m, "Message-Id: <custom@example.net>\r\n") {
+		t.Errorf("MessageID() doesn't take precedence:\n%s", m)
+	}
+}
+
+func TestHeadersMailer(t *testing.T) {
+	v := Version()
+	if v == "" {
+		t.Fatal("Version() is empty")
+	}
+
+	m, _, err := Message("Subject", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), HeadersMailer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\r\nX-Mailer: blackmail/" + v + "\r\n"; !strings.Contains(string(m), want) {
+		t.Errorf("no %q in:\n%s", want, m)
+	}
+}
+
+func TestThreading(t *testing.T) {
+	tests := []struct {
+		in   bodyPart
+		want []string
+	}{
+		{InReplyTo("a@example.com"), []string{"In-Reply-To", "<a@example.com>"}},
+		{InReplyTo(" <a@example.com>\t"), []string{"In-Reply-To", "<a@example.com>"}},
+		{References("a@example.com", " <b@example.com> ", "", "<c@example.com"),
+			[]string{"References", "<a@example.com> <b@example.com> <c@example.com>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.want, ": "), func(t *testing.T) {
+			if !reflect.DeepEqual(tt.in.headers, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", tt.in.headers, tt.want)
+			}
+		})
+	}
+
+	msg, _, err := Message("Re: thread", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), InReplyTo("b@example.com"), References("a@example.com", "b@example.com"),
+		Headers("X-Other", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "In-Reply-To: <b@example.com>\r\nReferences: <a@example.com> <b@example.com>\r\nX-Other: x\r\n") {
+		t.Errorf("wrong headers:\n%s", msg)
+	}
+}
+
+func TestGroupParts(t *testing.T) {
+	var structure func([]bodyPart) string
+	structure = func(parts []bodyPart) string {
+		var s []string
+		for _, p := range parts {
+			if p.isMultipart() {
+				s = append(s, p.ct+"("+structure(p.parts)+")")
+			} else {
+				s = append(s, p.ct)
+			}
+		}
+		return strings.Join(s, ", ")
+	}
+
+	var (
+		text = BodyText([]byte("x"))
+		html = BodyHTML([]byte("x"))
+		img  = InlineImage("image/png", "a.png", image.PNG)
+		pdf  = Attachment("application/pdf", "a.pdf", []byte("x"))
+	)
+	tests := []struct {
+		in   []bodyPart
+		want string
+	}{
+		{[]bodyPart{text, html}, "text/plain, text/html"},
+		{[]bodyPart{html, pdf}, "text/html, application/pdf"},
+		{[]bodyPart{text, html, pdf}, "multipart/alternative(text/plain, text/html), application/pdf"},
+		{[]bodyPart{img, html, text}, "text/plain, multipart/related(text/html, image/png)"},
+		{[]bodyPart{html, text}, "text/plain, text/html"},
+		{[]bodyPart{text, pdf, html, img},
+			"multipart/alternative(text/plain, multipart/related(text/html, image/png)), application/pdf"},
+		{[]bodyPart{text, img}, "text/plain, image/png"},
+		{[]bodyPart{text, Body("application/json", nil), pdf}, "text/plain, application/json, application/pdf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := structure(groupParts(tt.in))
+			if got != tt.want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFooter(t *testing.T) {
+	text := []byte("Hello")
+	msg, _, err := Message("Footer", From("", "me@example.com"), To("to@to.to"),
+		BodyText(text),
+		BodyHTML([]byte("<html><body><p>Hello</p></BODY></html>"), InlineImage("image/png", "a.png", image.PNG)),
+		Attachment("text/plain", "a.txt", []byte("Attached")),
+		Footer("\n\n-- \nUnsubscribe: https://example.com/u/1", `<p><a href="https://example.com/u/1">Unsubscribe</a></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := strings.ReplaceAll(string(msg), "=\r\n", "")
+	for _, want := range []string{
+		"Hello\r\n\r\n--=20\r\nUnsubscribe: https://example.com/u/1\r\n--",
+		`<p>Hello</p><p><a href=3D"https://example.com/u/1">Unsubscribe</a></p></BODY></html>`,
+		"Content-Type: text/plain; charset=utf-8; name=\"a.txt\"\r\n\r\nAttached\r\n--",
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("no %q in message:\n%s", want, m)
+		}
+	}
+	if string(text) != "Hello" {
+		t.Errorf("modified body: %q", text)
+	}
+}
+
+func TestAttachmentOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []bodyPart
+		want  []string
+	}{
+		{"binary", []bodyPart{Attachment("application/pdf", "a.pdf", []byte("%PDF-1.4"))},
+			[]string{"application/pdf"}},
+		{"text", []bodyPart{Attachment("text/calendar", "invite.ics", []byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"))},
+			[]string{"text/calendar"}},
+		{"two text", []bodyPart{
+			Attachment("text/plain", "a.txt", []byte("a")),
+			Attachment("text/html", "b.html", []byte("b"))},
+			[]string{"text/plain", "text/html"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _, err := Message("Attachments", From("", "me@example.com"), To("to@to.to"),
+				tt.parts[0], tt.parts[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := mail.ReadMessage(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != "multipart/mixed" {
+				t.Fatalf("Content-Type %q\n%s", mt, msg)
+			}
+
+			var got []string
+			mr := multipart.NewReader(m.Body, params["boundary"])
+			for {
+				p, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(p.Header.Get("Content-Disposition"), "attachment;") {
+					t.Errorf("wrong Content-Disposition: %q", p.Header.Get("Content-Disposition"))
+				}
+				ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+				got = append(got, ct)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachFile(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.WriteFile(tmp+"/img.png", image.PNG, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmp+"/report", []byte("%PDF-1.4"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in             bodyPart
+		wantCT, wantFn string
+		wantErr        string
+	}{
+		{AttachFile(tmp + "/img.png"), "image/png", "img.png", ""},
+		{AttachFile(tmp + "/report"), "application/pdf", "report", ""},
+		{AttachFile(tmp + "/report").Type("application/x-pdf"), "application/x-pdf", "report", ""},
+		{AttachFileAs(tmp+"/report", "report.pdf", ""), "application/pdf", "report.pdf", ""},
+		{AttachFileAs(tmp+"/report", "", "text/plain"), "text/plain", "report", ""},
+		{AttachFile(tmp + "/nonexistent"), "", "", "no such file or directory"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			if !ztest.ErrorContains(tt.in.err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", tt.in.err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			if tt.in.ct != tt.wantCT || tt.in.filename != tt.wantFn || !tt.in.attach {
+				t.Errorf("\ngot:  %q %q %t\nwant: %q %q", tt.in.ct, tt.in.filename, tt.in.attach, tt.wantCT, tt.wantFn)
+			}
+		})
+	}
 }
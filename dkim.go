@@ -0,0 +1,206 @@
+package blackmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DKIMOptions are the options for signing messages with DKIM() or DKIMSign().
+//
+// Every header in Headers signs one instance of that header, starting from the
+// bottom (RFC 6376 5.4.2). Headers that are listed more often than they appear
+// in the message are still added to the signature, which prevents them from
+// being added later ("over-signing"):
+//
+//	DKIMOptions{Headers: []string{"From", "From", "Subject", "Subject"}}
+//
+// If Headers is empty all instances of the headers in DKIMHeaders that appear
+// in the message are signed.
+type DKIMOptions struct {
+	Domain     string   // Signing domain (d=), usually the domain of the From address.
+	Selector   string   // Selector (s=); the public key is in the TXT record for [selector]._domainkey.[domain]
+	PrivateKey []byte   // PEM-encoded RSA private key, in PKCS #1 or PKCS #8 format.
+	Headers    []string // Headers to sign; DKIMHeaders is used if this is empty. From is always signed.
+}
+
+// DKIMHeaders are the headers that are signed if DKIMOptions.Headers is empty.
+var DKIMHeaders = []string{"From", "Reply-To", "To", "Cc", "Subject", "Date",
+	"Message-Id", "In-Reply-To", "References", "Mime-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Id", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// DKIM signs the message with DKIM (RFC 6376), using relaxed/relaxed
+// canonicalization and rsa-sha256.
+//
+// The DKIM-Signature header is added at the top of the message. Nothing in the
+// message should be changed after this, or the signature will be invalid.
+func DKIM(opts DKIMOptions) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.dkim = &opts }}
+}
+
+// DKIMSign is like DKIM(), but signs an existing message, for example for use
+// with Mailer.Deliver(). The message must have CRLF line endings.
+//
+// The signed message with the DKIM-Signature header is returned.
+func DKIMSign(msg []byte, opts DKIMOptions) ([]byte, error) {
+	if opts.Domain == "" || opts.Selector == "" {
+		return nil, errors.New("blackmail.DKIMSign: Domain and Selector must be set")
+	}
+	key, err := dkimKey(opts.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("blackmail.DKIMSign: %w", err)
+	}
+
+	head, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("blackmail.DKIMSign: no blank line after the header")
+	}
+	bh := sha256.Sum256(dkimBody(body))
+
+	// Every name in h= signs the next instance of that header, starting from
+	// the bottom. If there are no more instances it signs nothing, which is
+	// what over-signing relies on.
+	fields := dkimFields(head)
+	hdrs := opts.Headers
+	if len(hdrs) == 0 {
+		for _, h := range DKIMHeaders {
+			for _, f := range fields {
+				if f.name == strings.ToLower(h) {
+					hdrs = append(hdrs, h)
+				}
+			}
+		}
+	}
+	hasFrom := false
+	for _, h := range hdrs {
+		hasFrom = hasFrom || strings.EqualFold(h, "From")
+	}
+	if !hasFrom {
+		hdrs = append([]string{"From"}, hdrs...)
+	}
+	var (
+		names  []string
+		signed = new(strings.Builder)
+		used   = make(map[string]int)
+	)
+	for _, h := range hdrs {
+		h = strings.ToLower(h)
+		names = append(names, h)
+		skip := used[h]
+		used[h]++
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].name != h {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			signed.WriteString(dkimHeader(fields[i].raw) + "\r\n")
+			break
+		}
+	}
+
+	sig := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		opts.Domain, opts.Selector, now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+	signed.WriteString(dkimHeader("DKIM-Signature: " + sig))
+
+	h := sha256.Sum256([]byte(signed.String()))
+	b, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("blackmail.DKIMSign: %w", err)
+	}
+
+	out := make([]byte, 0, len(msg)+len(sig)+400)
+	out = append(out, "DKIM-Signature: "+sig+base64.StdEncoding.EncodeToString(b)+"\r\n"...)
+	return append(out, msg...), nil
+}
+
+func dkimKey(pemKey []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no PEM data in PrivateKey")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("PrivateKey is a %T; only RSA keys are supported", k)
+	}
+	return rsaKey, nil
+}
+
+type dkimField struct {
+	name string // Lower-case.
+	raw  string // Complete header, including continuation lines.
+}
+
+// dkimFields splits the header in to fields.
+func dkimFields(head []byte) []dkimField {
+	var fields []dkimField
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1].raw += "\r\n" + line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, dkimField{strings.ToLower(strings.TrimSpace(name)), line})
+	}
+	return fields
+}
+
+// dkimHeader canonicalizes a header with the "relaxed" algorithm (RFC 6376
+// 3.4.2), without the trailing CRLF.
+func dkimHeader(h string) string {
+	name, value, _ := strings.Cut(h, ":")
+	value = dkimWSP(strings.ReplaceAll(value, "\r\n", ""))
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + strings.TrimPrefix(value, " ")
+}
+
+// dkimBody canonicalizes the body with the "relaxed" algorithm (RFC 6376
+// 3.4.4).
+func dkimBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i := range lines {
+		lines[i] = dkimWSP(lines[i])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// dkimWSP reduces all sequences of spaces and tabs to a single space, and
+// removes any trailing spaces and tabs.
+func dkimWSP(l string) string {
+	b := make([]byte, 0, len(l))
+	wsp := false
+	for i := 0; i < len(l); i++ {
+		if l[i] == ' ' || l[i] == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b = append(b, ' ')
+			wsp = false
+		}
+		b = append(b, l[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,196 @@
+package blackmail
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail/internal/ztest"
+)
+
+func dkimTestKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// dkimTags gets the tags from the DKIM-Signature header at the top of msg.
+func dkimTags(t *testing.T, msg string) (string, map[string]string) {
+	t.Helper()
+	if !strings.HasPrefix(msg, "DKIM-Signature: ") {
+		t.Fatalf("no DKIM-Signature at the top:\n%s", msg)
+	}
+	end := regexp.MustCompile(`\r\n[^ \t]`).FindStringIndex(msg)
+	hdr := msg[:end[0]]
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.TrimPrefix(hdr, "DKIM-Signature: "), ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return hdr, tags
+}
+
+// dkimVerify checks the signature in the DKIM-Signature header hdr, where data
+// is the canonicalized signed headers.
+func dkimVerify(t *testing.T, key *rsa.PrivateKey, hdr string, tags map[string]string, data string) {
+	t.Helper()
+	sigHdr := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(hdr, "b=")
+	sigHdr = strings.Join(strings.Fields(strings.ReplaceAll(sigHdr, "\r\n", "")), " ")
+	data += "dkim-signature:" + strings.TrimPrefix(sigHdr, "DKIM-Signature: ")
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(data))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], sig); err != nil {
+		t.Errorf("invalid signature: %s", err)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	defer func() { now = func() time.Time { return time.Now() } }()
+	now = func() time.Time { return time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC) }
+
+	key, pemKey := dkimTestKey(t)
+	msg := ztest.CRLF("From: Me <me@example.com>\n" +
+		"To:  you@example.com \n" +
+		"Subject: Hello\n" +
+		"\tworld\n" +
+		"X-Not-Signed: yes\n" +
+		"\n" +
+		"Hello  \t world \n" +
+		"\n" +
+		"\n")
+
+	signed, err := DKIMSign([]byte(msg), DKIMOptions{
+		Domain:     "example.com",
+		Selector:   "sel",
+		PrivateKey: pemKey,
+		Headers:    []string{"Subject", "To", "X-Missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(signed), "\r\n"+msg) {
+		t.Fatalf("message was modified:\n%s", signed)
+	}
+
+	hdr, tags := dkimTags(t, string(signed))
+	want := map[string]string{
+		"v": "1", "a": "rsa-sha256", "c": "relaxed/relaxed", "d": "example.com",
+		"s": "sel", "t": "1704207845", "h": "from:subject:to:x-missing",
+	}
+	for k, v := range want {
+		if tags[k] != v {
+			t.Errorf("tag %s: got %q; want %q", k, tags[k], v)
+		}
+	}
+
+	bh := sha256.Sum256([]byte("Hello world\r\n"))
+	if want := base64.StdEncoding.EncodeToString(bh[:]); tags["bh"] != want {
+		t.Errorf("bh: got %q; want %q", tags["bh"], want)
+	}
+
+	dkimVerify(t, key, hdr, tags, "from:Me <me@example.com>\r\n"+
+		"subject:Hello world\r\n"+
+		"to:you@example.com\r\n")
+}
+
+func TestDKIMOverSign(t *testing.T) {
+	key, pemKey := dkimTestKey(t)
+	msg := ztest.CRLF("From: Me <me@example.com>\n" +
+		"To: you@example.com\n" +
+		"Subject: Hello\n" +
+		"\n" +
+		"Hello\n")
+
+	signed, err := DKIMSign([]byte(msg), DKIMOptions{
+		Domain:     "example.com",
+		Selector:   "sel",
+		PrivateKey: pemKey,
+		Headers:    []string{"From", "From", "Subject"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, tags := dkimTags(t, string(signed))
+	if want := "from:from:subject"; tags["h"] != want {
+		t.Errorf("h: got %q; want %q", tags["h"], want)
+	}
+	// The second From doesn't exist, so it doesn't add anything.
+	dkimVerify(t, key, hdr, tags, "from:Me <me@example.com>\r\n"+
+		"subject:Hello\r\n")
+}
+
+func TestDKIM(t *testing.T) {
+	_, pemKey := dkimTestKey(t)
+
+	m, _, err := Message("Subject", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), DKIM(DKIMOptions{Domain: "example.com", Selector: "sel", PrivateKey: pemKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tags := dkimTags(t, string(m))
+	if want := "from:to:subject:date:message-id:content-type:content-transfer-encoding"; tags["h"] != want {
+		t.Errorf("\ngot:  %s\nwant: %s", tags["h"], want)
+	}
+	if w, err := Lint(m); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, ww := range w {
+			if ww.Check == "dkim" {
+				t.Errorf("Lint: %s", ww)
+			}
+		}
+	}
+
+	_, _, err = Message("Subject", From("", "me@example.com"), To("to@to.to"),
+		Bodyf("Hello"), DKIM(DKIMOptions{Domain: "example.com", Selector: "sel", PrivateKey: []byte("x")}))
+	if want := "blackmail.DKIMSign: no PEM data in PrivateKey"; !ztest.ErrorContains(err, want) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// The body hash should match the body as received by the server, after
+// dot-stuffing and unstuffing.
+func TestDKIMRelay(t *testing.T) {
+	srv, addr := startServer(t)
+	_, pemKey := dkimTestKey(t)
+
+	err := NewMailer("smtp://"+addr).Send("Subject", From("", "me@example.com"), To("to@to.to"),
+		Bodyf(".leading dot\n..two dots\n.\ntrailing space  \n\n\n"),
+		DKIM(DKIMOptions{Domain: "example.com", Selector: "sel", PrivateKey: pemKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages; want 1", len(msgs))
+	}
+
+	msg := strings.ReplaceAll(msgs[0], "\n", "\r\n")
+	_, tags := dkimTags(t, msg)
+	_, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no body:\n%s", msg)
+	}
+	if !strings.Contains(body, "\r\n.\r\n") {
+		t.Errorf("line with only a dot not in body:\n%s", body)
+	}
+	bh := sha256.Sum256(dkimBody([]byte(body)))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != tags["bh"] {
+		t.Errorf("bh: got %q; want %q", got, tags["bh"])
+	}
+}
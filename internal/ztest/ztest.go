@@ -229,6 +229,17 @@ func NormalizeIndent(in string) string {
 	return strings.TrimSpace(r)
 }
 
+// CRLF converts LF line endings in s to CRLF, as used by SMTP and in email
+// messages. Line endings that are already CRLF are left alone.
+func CRLF(s string) string {
+	return strings.ReplaceAll(LF(s), "\n", "\r\n")
+}
+
+// LF converts CRLF line endings in s to LF.
+func LF(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
 // R recovers a panic and cals t.Fatal().
 //
 // This is useful especially in subtests when you want to run a top-level defer.
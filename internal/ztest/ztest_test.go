@@ -136,6 +136,31 @@ func TestNormalizeIndent(t *testing.T) {
 	}
 }
 
+func TestCRLF(t *testing.T) {
+	tests := []struct {
+		in, wantCRLF, wantLF string
+	}{
+		{"", "", ""},
+		{"a", "a", "a"},
+		{"a\nb\n", "a\r\nb\r\n", "a\nb\n"},
+		{"a\r\nb\r\n", "a\r\nb\r\n", "a\nb\n"},
+		{"a\r\nb\nc", "a\r\nb\r\nc", "a\nb\nc"},
+		{"\n\n", "\r\n\r\n", "\n\n"},
+		{"a\rb\r", "a\rb\r", "a\rb\r"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if have := CRLF(tt.in); have != tt.wantCRLF {
+				t.Errorf("CRLF\nhave: %q\nwant: %q", have, tt.wantCRLF)
+			}
+			if have := LF(tt.in); have != tt.wantLF {
+				t.Errorf("LF\nhave: %q\nwant: %q", have, tt.wantLF)
+			}
+		})
+	}
+}
+
 func TestDiff(t *testing.T) {
 	tests := []struct {
 		inOut, inWant string
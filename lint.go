@@ -0,0 +1,174 @@
+package blackmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// LintMaxImageSize is the maximum size of images before Lint() warns about
+// them.
+var LintMaxImageSize = 1024 * 1024
+
+// Lint checks a message for common problems that are likely to make spam
+// filters reject or junk it:
+//
+//   html-only          text/html part without a text/plain alternative.
+//   list-unsubscribe   bulk or mailing list message without List-Unsubscribe.
+//   image-size         image larger than LintMaxImageSize.
+//   dkim               no DKIM signature for the From domain.
+//   subject            Subject with raw 8bit data, or needless or unusual encoding.
+//
+// The message can be any RFC 5322 message, but is usually created with
+// Message().
+func Lint(msg []byte) ([]Warning, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("blackmail.Lint: %w", err)
+	}
+
+	var (
+		warn     []Warning
+		haveText bool
+		haveHTML bool
+		h        = textproto.MIMEHeader(m.Header)
+	)
+	err = walkParts(h, m.Body, func(h textproto.MIMEHeader, body []byte) {
+		mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		switch {
+		case mt == "" || mt == "text/plain":
+			if h.Get("Content-Disposition") == "" {
+				haveText = true
+			}
+		case mt == "text/html":
+			haveHTML = true
+		case strings.HasPrefix(mt, "image/"):
+			if len(body) > LintMaxImageSize {
+				warn = append(warn, Warning{"image-size", fmt.Sprintf(
+					"image %q is %d bytes; the maximum is %d", fname(h), len(body), LintMaxImageSize)})
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("blackmail.Lint: %w", err)
+	}
+
+	if haveHTML && !haveText {
+		warn = append(warn, Warning{"html-only", "text/html part without a text/plain alternative"})
+	}
+
+	prec := strings.ToLower(h.Get("Precedence"))
+	if (prec == "bulk" || prec == "list" || h.Get("List-Id") != "") && h.Get("List-Unsubscribe") == "" {
+		warn = append(warn, Warning{"list-unsubscribe", "bulk or mailing list message without List-Unsubscribe header"})
+	}
+
+	if w := lintDKIM(m.Header); w != "" {
+		warn = append(warn, Warning{"dkim", w})
+	}
+	if w := lintSubject(h.Get("Subject")); w != "" {
+		warn = append(warn, Warning{"subject", w})
+	}
+	return warn, nil
+}
+
+func lintDKIM(h mail.Header) string {
+	from, err := h.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return "no valid From header"
+	}
+	domain := strings.ToLower(from[0].Address[strings.LastIndex(from[0].Address, "@")+1:])
+
+	for _, sig := range h["Dkim-Signature"] {
+		for _, tag := range strings.Split(sig, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(tag), "=")
+			if !ok || strings.TrimSpace(k) != "d" {
+				continue
+			}
+			v = strings.ToLower(strings.TrimSpace(v))
+			if v == domain || strings.HasSuffix(domain, "."+v) {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("no DKIM signature for the From domain %q", domain)
+}
+
+func lintSubject(subj string) string {
+	for _, c := range []byte(subj) {
+		if c > 127 {
+			return "Subject contains unencoded 8bit data"
+		}
+	}
+
+	if !strings.Contains(subj, "=?") {
+		return ""
+	}
+	var charset string
+	dec := &mime.WordDecoder{CharsetReader: func(cs string, input io.Reader) (io.Reader, error) {
+		charset = cs
+		return input, nil
+	}}
+	d, err := dec.DecodeHeader(subj)
+	if err != nil {
+		return fmt.Sprintf("invalid Subject encoding: %s", err)
+	}
+	if d == subj { // Not actually encoded.
+		return ""
+	}
+	if charset != "" {
+		return fmt.Sprintf("Subject uses unusual charset %q", charset)
+	}
+	for _, c := range []byte(d) {
+		if c > 127 {
+			return ""
+		}
+	}
+	return "Subject is encoded but only contains ASCII"
+}
+
+// walkParts calls fn for every non-multipart part in the body, with the decoded
+// body.
+func walkParts(h textproto.MIMEHeader, body io.Reader, fn func(textproto.MIMEHeader, []byte)) error {
+	mt, params, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = walkParts(p.Header, p, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body) // Ignores CRLF.
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	fn(h, b)
+	return nil
+}
+
+func fname(h textproto.MIMEHeader) string {
+	_, params, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	return params["filename"]
+}
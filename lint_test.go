@@ -0,0 +1,80 @@
+package blackmail
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	defer func(n int) { LintMaxImageSize = n }(LintMaxImageSize)
+	LintMaxImageSize = 100
+
+	tests := []struct {
+		name  string
+		parts []bodyPart
+		want  []string
+	}{
+		{"good", []bodyPart{
+			Headers("DKIM-Signature", "v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=x; b=x"),
+			BodyText([]byte("Hello")),
+			BodyHTML([]byte("<p>Hello</p>")),
+		}, nil},
+
+		{"bad", []bodyPart{
+			Headers("Precedence", "bulk",
+				"Subject", "=?utf-8?q?Hello?="),
+			BodyHTML([]byte(`<p>Hello <img src="cid:blackmail:1"></p>`),
+				InlineImage("image/png", "big.png", bytes.Repeat([]byte("x"), 101))),
+		}, []string{"image-size", "html-only", "list-unsubscribe", "dkim", "subject"}},
+
+		{"dkim-other-domain", []bodyPart{
+			Headers("DKIM-Signature", "v=1; d=other.com; s=sel"),
+			BodyText([]byte("Hello")),
+		}, []string{"dkim"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _, err := Message("Subject", From("", "me@example.com"), To("to@to.to"),
+				tt.parts[0], tt.parts[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			warn, err := Lint(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, w := range warn {
+				got = append(got, w.Check)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %v\nwant: %v\n%s", got, tt.want, warn)
+			}
+		})
+	}
+}
+
+func TestLintSubject(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Hello", ""},
+		{"=?utf-8?q?H=C3=A9llo?=", ""},
+		{"Héllo", "Subject contains unencoded 8bit data"},
+		{"=?utf-8?q?Hello?=", "Subject is encoded but only contains ASCII"},
+		{"=?koi8-r?q?=F0=D2=C9?=", `Subject uses unusual charset "koi8-r"`},
+		{"=?utf-8?x?Hello?=", ""}, // Invalid encoded-words are kept as-is.
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := lintSubject(tt.in)
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,236 @@
 package blackmail
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/mail"
+	"net"
+	"net/url"
+	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"zgo.at/blackmail/smtp"
 )
 
 type (
 	sender interface {
-		send(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) error
+		send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error)
 	}
 	senderOpt func(sender)
+
+	// verifier is implemented by senders that support Mailer.Verify().
+	verifier interface {
+		verify(ctx context.Context) error
+	}
+
+	// closer is implemented by senders that keep a connection open.
+	closer interface {
+		close() error
+	}
+
+	// batchSender is implemented by senders that support Mailer.SendBatch().
+	batchSender interface {
+		sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error)
+	}
+
+	// preflighter is implemented by senders that support Mailer.PreflightCheck().
+	preflighter interface {
+		preflight(domain, selector string) []Warning
+	}
 )
 
+// verify the sender, returning an error if it doesn't support it.
+func verify(ctx context.Context, s sender) error {
+	v, ok := s.(verifier)
+	if !ok {
+		return fmt.Errorf("blackmail.Mailer.Verify: not supported for %T", s)
+	}
+	return v.verify(ctx)
+}
+
+// closeSender closes the sender if it keeps a connection open.
+func closeSender(s sender) error {
+	c, ok := s.(closer)
+	if !ok {
+		return nil
+	}
+	return c.close()
+}
+
+// preflight runs the preflight checks for the sender, returning nil if it
+// doesn't support it.
+func preflight(s sender, domain, selector string) []Warning {
+	p, ok := s.(preflighter)
+	if !ok {
+		return nil
+	}
+	return p.preflight(domain, selector)
+}
+
+// sendBatch sends with the sender, returning an error if it doesn't support it.
+func sendBatch(ctx context.Context, s sender, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	b, ok := s.(batchSender)
+	if !ok {
+		return nil, errors.New("blackmail.Mailer.SendBatch: only supported for the relay mailer")
+	}
+	return b.sendBatch(ctx, from, to, msg, opts)
+}
+
+// Allow swapping out in tests.
+var osHostname = os.Hostname
+
+// helloName gets the name to use for HELO/EHLO: the hostname if it's a FQDN, or
+// the address literal of the local address (e.g. "[192.0.2.10]") if it's not,
+// as many servers reject non-FQDN names (RFC 5321 4.1.4).
+func helloName(local net.Addr) string {
+	h, err := osHostname()
+	if err == nil && strings.Contains(strings.Trim(h, "."), ".") {
+		return h
+	}
+
+	tcp, ok := local.(*net.TCPAddr)
+	if !ok || tcp.IP == nil {
+		return "localhost"
+	}
+	if ip := tcp.IP.To4(); ip != nil {
+		return "[" + ip.String() + "]"
+	}
+	return "[IPv6:" + tcp.IP.String() + "]"
+}
+
+// mailOptions gets the options for the MAIL command.
+//
+// Addresses with non-ASCII characters require SMTPUTF8 (RFC 6531); the server
+// will return an error if it doesn't support it. The size is sent so the server
+// can reject messages that are too large before we send them.
+func mailOptions(from string, to []string, msg []byte, opts msgOpts) *smtp.MailOptions {
+	mo := &smtp.MailOptions{
+		Size:       len(msg),
+		Return:     smtp.DSNReturn(opts.dsnReturn),
+		EnvelopeID: opts.envelopeID,
+	}
+	for _, a := range append([]string{from}, to...) {
+		for _, c := range []byte(a) {
+			if c > 127 {
+				mo.UTF8 = true
+			}
+		}
+	}
+	return mo
+}
+
+// requireTLS returns a copy of opts with RequireTLS set.
+func requireTLS(opts *smtp.MailOptions) *smtp.MailOptions {
+	var mo smtp.MailOptions
+	if opts != nil {
+		mo = *opts
+	}
+	mo.RequireTLS = true
+	return &mo
+}
+
+type senderRetry struct {
+	sender
+	attempts int
+	backoff  func(int) time.Duration
+}
+
+func (s senderRetry) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	var res SendResult
+	err := s.retry(ctx, func() (err error) {
+		res, err = s.sender.send(ctx, from, to, msg, opts)
+		return err
+	})
+	return res, err
+}
+
+func (s senderRetry) sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	var errs map[string]error
+	err := s.retry(ctx, func() (err error) {
+		errs, err = sendBatch(ctx, s.sender, from, to, msg, opts)
+		return err
+	})
+	return errs, err
+}
+
+// retry fn until it succeeds, returns a permanent error, or we run out of
+// attempts.
+func (s senderRetry) retry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= s.attempts || !temporary(err) {
+			return err
+		}
+
+		var wait time.Duration
+		if s.backoff != nil {
+			wait = s.backoff(attempt)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (s senderRetry) verify(ctx context.Context) error { return verify(ctx, s.sender) }
+func (s senderRetry) close() error                     { return closeSender(s.sender) }
+func (s senderRetry) preflight(domain, selector string) []Warning {
+	return preflight(s.sender, domain, selector)
+}
+
+// temporary reports if err is a temporary error that may succeed if retried.
+func temporary(err error) bool {
+	var (
+		smtpErr *smtp.SMTPError
+		softErr SoftError
+	)
+	return (errors.As(err, &smtpErr) && smtpErr.Temporary()) || errors.As(err, &softErr)
+}
+
+// sendResult creates a SendResult from the DATA response, using the queue ID
+// from parse if it's set and returns something.
+func sendResult(resp *smtp.DataResponse, parse func(string) string) SendResult {
+	r := SendResult{Response: resp.StatusText, QueueID: resp.QueueID}
+	if parse != nil {
+		if id := parse(resp.StatusText); id != "" {
+			r.QueueID = id
+		}
+	}
+	return r
+}
+
+// dial addr with d, using the context's deadline (if any) as the deadline for
+// the connection. A nil dialer is the same as a zero net.Dialer.
+//
+// If proxy is set it's used as the URL to a SOCKS5 proxy to connect through.
+func dial(ctx context.Context, d *net.Dialer, proxy, addr string) (net.Conn, error) {
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		return dialSOCKS5(ctx, d, u, addr)
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	return conn, nil
+}
+
 func warn(opt string, s sender) {
 	fmt.Fprintf(stderr, "blackmail.NewMailer: %s is not valid for %T; option ignored\n", opt, s)
 }
@@ -23,14 +240,242 @@ type senderWriter struct {
 	w  io.Writer
 }
 
-func (s senderWriter) send(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) error {
-	msg, _, err := message(subject, from, rcpt, firstPart, parts...)
+func (s senderWriter) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	s.mu.Lock()
+	fmt.Fprint(s.w, string(msg))
+	s.mu.Unlock()
+	return SendResult{}, nil
+}
+
+type senderRing struct {
+	sender
+	mu   *sync.Mutex
+	n    int
+	msgs []SentMessage
+}
+
+func (s *senderRing) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	res, err := s.sender.send(ctx, from, to, msg, opts)
+	s.record(from, to, msg, err)
+	return res, err
+}
+
+func (s *senderRing) sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	errs, err := sendBatch(ctx, s.sender, from, to, msg, opts)
+	s.record(from, to, msg, err)
+	return errs, err
+}
+
+// record a message, removing the oldest one if the ring is full.
+func (s *senderRing) record(from string, to []string, msg []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Copy, as with Deliver() the slices are owned by the caller.
+	s.msgs = append(s.msgs, SentMessage{Time: now(), From: from,
+		To: append([]string{}, to...), Msg: append([]byte{}, msg...), Err: err})
+	if len(s.msgs) > s.n {
+		s.msgs = append(s.msgs[:0], s.msgs[len(s.msgs)-s.n:]...)
+	}
+}
+
+func (s *senderRing) verify(ctx context.Context) error { return verify(ctx, s.sender) }
+func (s *senderRing) close() error                     { return closeSender(s.sender) }
+func (s *senderRing) preflight(domain, selector string) []Warning {
+	return preflight(s.sender, domain, selector)
+}
+
+// How long a mailer is skipped after failing in NewMailerBalancer().
+var balancerCooldown = time.Minute
+
+type senderBalancer struct {
+	senders []sender
+
+	mu     *sync.Mutex
+	next   int
+	failed []time.Time // Last failure for every sender.
+}
+
+func (s *senderBalancer) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	i, err := s.pick()
 	if err != nil {
-		return err
+		return SendResult{}, err
+	}
+	res, err := s.senders[i].send(ctx, from, to, msg, opts)
+	s.done(i, err)
+	return res, err
+}
+
+func (s *senderBalancer) sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	i, err := s.pick()
+	if err != nil {
+		return nil, err
+	}
+	errs, err := sendBatch(ctx, s.senders[i], from, to, msg, opts)
+	s.done(i, err)
+	return errs, err
+}
+
+// pick the next sender to use, skipping senders that failed recently (unless
+// all of them did).
+func (s *senderBalancer) pick() (int, error) {
+	if len(s.senders) == 0 {
+		return 0, errors.New("blackmail.NewMailerBalancer: no mailers")
 	}
 
 	s.mu.Lock()
-	fmt.Fprint(s.w, string(msg))
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	t, i := now(), s.next
+	for n := range s.senders {
+		j := (s.next + n) % len(s.senders)
+		if t.Sub(s.failed[j]) >= balancerCooldown {
+			i = j
+			break
+		}
+	}
+	s.next = (i + 1) % len(s.senders)
+	return i, nil
+}
+
+// done records the result of sending with sender i.
+func (s *senderBalancer) done(i int, err error) {
+	if err != nil {
+		s.mu.Lock()
+		s.failed[i] = now()
+		s.mu.Unlock()
+	}
+}
+
+// verify all the mailers.
+func (s *senderBalancer) verify(ctx context.Context) error {
+	for _, ss := range s.senders {
+		if err := verify(ctx, ss); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// close all the mailers, returning the first error.
+func (s *senderBalancer) close() error {
+	var firstErr error
+	for _, ss := range s.senders {
+		if err := closeSender(ss); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// preflight runs the preflight checks for all mailers.
+func (s *senderBalancer) preflight(domain, selector string) []Warning {
+	var warn []Warning
+	for _, ss := range s.senders {
+		warn = append(warn, preflight(ss, domain, selector)...)
+	}
+	return warn
+}
+
+type senderBreaker struct {
+	sender
+	opts CircuitBreaker
+
+	mu        *sync.Mutex
+	sends     []*breakerSend // Sends within the window, oldest first.
+	openUntil time.Time
+}
+
+type breakerSend struct {
+	t      time.Time
+	done   bool // Set once the send completes.
+	failed bool
+}
+
+func (s *senderBreaker) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	b, err := s.allow()
+	if err != nil {
+		return SendResult{}, err
+	}
+	res, err := s.sender.send(ctx, from, to, msg, opts)
+	s.done(b, err)
+	return res, err
+}
+
+func (s *senderBreaker) sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	b, err := s.allow()
+	if err != nil {
+		return nil, err
+	}
+	errs, err := sendBatch(ctx, s.sender, from, to, msg, opts)
+	s.done(b, err)
+	return errs, err
+}
+
+// allow returns ErrCircuitOpen if the breaker is open, or if sending would
+// exceed MaxSends.
+//
+// The send is recorded right away, so that concurrent sends count towards
+// MaxSends; pass the returned value to done() once it completes.
+func (s *senderBreaker) allow() (*breakerSend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := now()
+	if t.Before(s.openUntil) {
+		return nil, ErrCircuitOpen
+	}
+	s.prune(t)
+	if s.opts.MaxSends > 0 && len(s.sends) >= s.opts.MaxSends {
+		s.trip(t)
+		return nil, ErrCircuitOpen
+	}
+	b := &breakerSend{t: t}
+	s.sends = append(s.sends, b)
+	return b, nil
+}
+
+// done records the result of a send, tripping the breaker if the error rate
+// is too high. Sends that are still in progress aren't counted for the error
+// rate.
+func (s *senderBreaker) done(b *breakerSend, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.done, b.failed = true, err != nil
+
+	t := now()
+	s.prune(t)
+	if s.opts.MaxErrorRate > 0 {
+		var n, failed int
+		for _, ss := range s.sends {
+			if ss.done {
+				n++
+			}
+			if ss.failed {
+				failed++
+			}
+		}
+		if n >= s.opts.MinSends && n > 0 && float64(failed)/float64(n) > s.opts.MaxErrorRate {
+			s.trip(t)
+		}
+	}
+}
+
+func (s *senderBreaker) verify(ctx context.Context) error { return verify(ctx, s.sender) }
+func (s *senderBreaker) close() error                     { return closeSender(s.sender) }
+func (s *senderBreaker) preflight(domain, selector string) []Warning {
+	return preflight(s.sender, domain, selector)
+}
+
+// prune removes sends that are outside the window.
+func (s *senderBreaker) prune(t time.Time) {
+	i := 0
+	for i < len(s.sends) && t.Sub(s.sends[i].t) >= s.opts.Window {
+		i++
+	}
+	s.sends = append(s.sends[:0], s.sends[i:]...)
+}
+
+// trip the breaker; the counts are reset so it starts fresh after the
+// cooldown.
+func (s *senderBreaker) trip(t time.Time) {
+	s.openUntil = t.Add(s.opts.Cooldown)
+	s.sends = s.sends[:0]
+}
@@ -1,146 +1,360 @@
 package blackmail
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
-	"net/mail"
-	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"zgo.at/blackmail/smtp"
 )
 
 type senderDirect struct {
-	tls        *tls.Config
-	requireTLS bool
+	tls           *tls.Config
+	requireTLS    bool
+	requireTLSExt bool
+	verifyTLS     bool
+	queueID       func(string) string
+	timeout       time.Duration
+	hedge         time.Duration
+	dialer        *net.Dialer
+	proxy         string
 }
 
-var hostname sync.Once
+// Allow swapping out in tests.
+var (
+	lookupMX   = net.LookupMX
+	lookupTXT  = net.LookupTXT
+	directPort = "25"
+)
 
-// TODO: use requireStartTLS
-// TODO: use tls
-func (s senderDirect) send(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) error {
-	panic("WIP")
+// Warning is a potential problem reported by PreflightCheck() or Lint().
+type Warning struct {
+	Check string // Which check failed; see PreflightCheck() and Lint() for the list.
+	Msg   string
+}
 
-	msg, to, err := message(subject, from, rcpt, firstPart, parts...)
-	if err != nil {
-		return err
+func (w Warning) String() string { return w.Check + ": " + w.Msg }
+
+func haveSPF(txt []string) bool {
+	for _, t := range txt {
+		if t == "v=spf1" || strings.HasPrefix(t, "v=spf1 ") {
+			return true
+		}
 	}
+	return false
+}
 
-	hello := "localhost"
-	var hostErr error
-	hostname.Do(func() {
-		var err error
-		hello, err = os.Hostname()
-		if err != nil {
-			hostErr = err
+// haveDKIM reports if there is a DKIM key record with a public key; an empty
+// "p=" means the key was revoked.
+func haveDKIM(txt []string) bool {
+	for _, t := range txt {
+		for _, tag := range strings.Split(t, ";") {
+			k, v, _ := strings.Cut(tag, "=")
+			if strings.TrimSpace(k) == "p" && strings.TrimSpace(v) != "" {
+				return true
+			}
 		}
-	})
-	if hostErr != nil {
-		return fmt.Errorf("senderDirect.send: getting hostname: %w", hostErr)
+	}
+	return false
+}
+
+func (s senderDirect) preflight(domain, selector string) []Warning {
+	var (
+		warn   []Warning
+		dnsErr *net.DNSError
+	)
+
+	txt, err := lookupTXT(domain)
+	switch {
+	case err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound):
+		warn = append(warn, Warning{"spf", fmt.Sprintf("looking up TXT records for %q: %s", domain, err)})
+	case !haveSPF(txt):
+		warn = append(warn, Warning{"spf", fmt.Sprintf("no SPF record for %q; many servers will reject or junk the email", domain)})
+	}
+
+	if selector == "" {
+		warn = append(warn, Warning{"dkim", "no DKIM selector; messages must be DKIM-signed with DKIM(), or many servers will reject or junk the email"})
+		return warn
+	}
+	name := selector + "._domainkey." + domain
+	txt, err = lookupTXT(name)
+	switch {
+	case err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound):
+		warn = append(warn, Warning{"dkim", fmt.Sprintf("looking up TXT records for %q: %s", name, err)})
+	case !haveDKIM(txt):
+		warn = append(warn, Warning{"dkim", fmt.Sprintf("no DKIM key for %q; many servers will reject or junk the email", name)})
+	}
+	return warn
+}
+
+func (s senderDirect) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	if s.requireTLSExt {
+		opts = requireTLS(opts)
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
 	}
 
 	groupedTo := make(map[string][]string)
 	for _, t := range to {
-		d := t[strings.LastIndex(t, "@")+1:]
+		d := strings.ToLower(t[strings.LastIndex(t, "@")+1:])
 		groupedTo[d] = append(groupedTo[d], t)
 	}
 
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		res  SendResult
+		errs = make(DirectError)
+	)
 	for domain, t := range groupedTo {
-		// Run in goroutine and wait.
-		func(t []string) {
-			for _, h := range s.getMX(domain) {
-				err := s.mail(h, hello, from.Address, t, msg)
-				if err != nil {
-					var softErr *SoftError
-					if errors.As(err, &softErr) {
-						continue
-					}
-				}
+		wg.Add(1)
+		go func(domain string, t []string) {
+			defer wg.Done()
+			r, err := s.deliver(ctx, domain, from, t, msg, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[domain] = err
+				return
+			}
+			res = r
+		}(domain, t)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return SendResult{}, errs
+	}
+	if len(groupedTo) > 1 {
+		// Every server has its own response, so there's nothing meaningful to
+		// return.
+		return SendResult{}, nil
+	}
+	return res, nil
+}
 
-				// Either a hard error or we sent successfully.
-				break
+// deliver to all the MX hosts for a domain in order, until one of them accepts
+// the message or returns a hard error.
+func (s senderDirect) deliver(ctx context.Context, domain, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	hosts, err := s.hosts(domain)
+	if err != nil {
+		return SendResult{}, err
+	}
+	var (
+		res  SendResult
+		conn net.Conn
+		i    int
+	)
+	for len(hosts) > 0 {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return SendResult{}, ctxErr
+		}
+
+		conn, i, err = s.dialMX(ctx, hosts)
+		host := hosts[i]
+		hosts = hosts[i+1:]
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return SendResult{}, ctxErr
 			}
-		}(t)
+			err = SoftError{err} // Can't connect: try next MX
+			continue
+		}
+
+		res, err = s.mail(ctx, conn, host, from, to, msg, opts)
+		var softErr SoftError
+		if errors.As(err, &softErr) {
+			continue
+		}
+
+		// Either a hard error or we sent successfully.
+		break
 	}
-	return nil
+	return res, err
 }
 
-func (s senderDirect) mail(host, hello, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(host + ":25")
+// dialMX connects to the first host in hosts, returning the connection and the
+// index of the host it connected to.
+//
+// If hedging is enabled it also starts connecting to the next host if there is
+// no connection after the hedge delay (or if connecting failed), and uses
+// whichever connects first. On errors the index is that of the last host that
+// was tried.
+func (s senderDirect) dialMX(ctx context.Context, hosts []string) (net.Conn, int, error) {
+	if s.hedge <= 0 || len(hosts) == 1 {
+		conn, err := dial(ctx, s.dialer, s.proxy, net.JoinHostPort(hosts[0], directPort))
+		return conn, 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		i    int
+		err  error
+	}
+	var (
+		ch      = make(chan result, len(hosts))
+		next    int
+		pending int
+		hedge   <-chan time.Time
+		lastErr error
+	)
+	start := func() {
+		go func(i int) {
+			conn, err := dial(ctx, s.dialer, s.proxy, net.JoinHostPort(hosts[i], directPort))
+			ch <- result{conn, i, err}
+		}(next)
+		next++
+		pending++
+		hedge = nil
+		if next < len(hosts) {
+			hedge = time.After(s.hedge)
+		}
+	}
+
+	start()
+	for pending > 0 {
+		select {
+		case <-hedge:
+			start()
+		case r := <-ch:
+			pending--
+			if r.err != nil {
+				lastErr = r.err
+				if pending == 0 && next < len(hosts) {
+					start()
+				}
+				continue
+			}
+
+			// Close connections that are still being established.
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-ch; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, r.i, nil
+		}
+	}
+	return nil, next - 1, lastErr
+}
+
+func (s senderDirect) mail(ctx context.Context, conn net.Conn, host, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		// Blocked as spam is a fatal errorr; don't try again.
+		conn.Close()
+
+		// Blocked as spam is a fatal error; don't try again.
 		//
 		// 14:52:24 ERROR: 554 5.7.1 Service unavailable; Client host [xxx.xxx.xx.xx] blocked using
 		// xbl.spamhaus.org.rbl.local; https://www.spamhaus.org/query/ip/xxx.xxx.xx.xx
 		if strings.Contains(err.Error(), " blocked ") {
-			return err
+			return SendResult{}, err
 		}
-
-		// Can't connect: try next MX
-		return SoftError{err}
+		return SendResult{}, SoftError{err}
 	}
 	defer c.Close()
 
-	err = c.Hello(hello)
+	err = c.Hello(helloName(conn.LocalAddr()))
 	if err != nil {
-		return err
-
-		// Errors from here on are probably fatal error, so just
-		// abort.
-		// TODO: could improve by checking the status code, but
-		// net/smtp doesn't provide them in a good way. This is fine
-		// for now as it's intended as a simple backup solution.
-		//break
+		return SendResult{}, err
 	}
 
 	if ok, _ := c.Extension("STARTTLS"); ok {
-		err := c.StartTLS(&tls.Config{ServerName: host})
+		tlsc := &tls.Config{}
+		if s.tls != nil {
+			tlsc = s.tls.Clone()
+		}
+		tlsc.ServerName = strings.TrimSuffix(host, ".")
+		if !s.verifyTLS {
+			// Many MX hosts have self-signed or otherwise invalid
+			// certificates; like most MTAs, encrypt anyway as that's still
+			// better than plain text.
+			tlsc.InsecureSkipVerify = true
+		}
+		err := c.StartTLS(tlsc)
 		if err != nil {
-			return err
+			return SendResult{}, err
 		}
+	} else if s.requireTLS {
+		return SendResult{}, fmt.Errorf("%s doesn't support STARTTLS", host)
 	}
 
-	err = c.Mail(from, nil)
+	err = c.Mail(from, opts)
 	if err != nil {
-		return err
+		return SendResult{}, err
 	}
-	// TODO: group by domains.
 	for _, addr := range to {
 		err = c.Rcpt(addr)
 		if err != nil {
-			return err
+			return SendResult{}, err
 		}
 	}
 
 	w, err := c.Data()
 	if err != nil {
-		return err
+		return SendResult{}, err
 	}
 	_, err = w.Write(msg)
 	if err != nil {
-		return err
+		return SendResult{}, err
 	}
 
-	err = w.Close()
+	resp, err := w.CloseWithResponse()
 	if err != nil {
-		return err
+		return SendResult{}, err
 	}
 
 	err = c.Quit()
 	if err != nil {
-		return err
+		return SendResult{}, err
 	}
 
-	return nil
+	return sendResult(resp, s.queueID), nil
+}
+
+// hosts gets the list of hosts to deliver to for domain.
+//
+// This is usually the MX records, but domain can also be an address literal
+// such as "[192.0.2.1]" or "[IPv6:2001:db8::1]" (RFC 5321 4.1.3), in which case
+// it's delivered to that IP without looking up MX records.
+func (s senderDirect) hosts(domain string) ([]string, error) {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		lit := domain[1 : len(domain)-1]
+		ip := net.ParseIP(lit)
+		if len(lit) > 5 && strings.EqualFold(lit[:5], "IPv6:") {
+			ip = net.ParseIP(lit[5:])
+			if ip != nil && ip.To4() != nil {
+				ip = nil
+			}
+		} else if ip != nil && ip.To4() == nil {
+			ip = nil // IPv6 must have the "IPv6:" prefix.
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("senderDirect: invalid address literal: %q", domain)
+		}
+		return []string{ip.String()}, nil
+	}
+
+	return s.getMX(domain), nil
 }
 
 // TODO: cache for same domains.
 func (s senderDirect) getMX(domain string) []string {
-	mxs, err := net.LookupMX(domain)
+	mxs, err := lookupMX(domain)
 	if err != nil {
 		return []string{domain}
 	}
@@ -152,6 +366,32 @@ func (s senderDirect) getMX(domain string) []string {
 	return hosts
 }
 
+// DirectError is returned by the direct mailer if sending to one or more
+// domains failed, with the domain name as the key.
+//
+// The message was delivered to all other domains.
+type DirectError map[string]error
+
+func (e DirectError) Error() string {
+	domains := make([]string, 0, len(e))
+	for d := range e {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	b := new(strings.Builder)
+	b.WriteString("blackmail.senderDirect: ")
+	for i, d := range domains {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(b, "%s: %s", d, e[d])
+	}
+	return b.String()
+}
+
+// SoftError is a temporary error for one MX host; the next MX host will be
+// tried.
 type SoftError struct{ err error }
 
 func (f SoftError) Error() string { return f.err.Error() }
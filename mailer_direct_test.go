@@ -0,0 +1,222 @@
+package blackmail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail/internal/ztest"
+)
+
+// useServer makes the direct mailer connect to addr, using the MX records in
+// mx.
+func useServer(t *testing.T, addr string, mx map[string][]string) {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origMX, origPort := lookupMX, directPort
+	t.Cleanup(func() { lookupMX, directPort = origMX, origPort })
+
+	directPort = port
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		hosts, ok := mx[domain]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+		}
+		r := make([]*net.MX, len(hosts))
+		for i := range hosts {
+			r[i] = &net.MX{Host: hosts[i], Pref: uint16(i * 10)}
+		}
+		return r, nil
+	}
+}
+
+func TestDirect(t *testing.T) {
+	srv, addr := startServer(t)
+	useServer(t, addr, map[string][]string{
+		// Nothing listens on 127.0.0.2, so it should fall through to the next
+		// MX.
+		"example.com": {"127.0.0.2", "127.0.0.1"},
+		"example.net": {"127.0.0.1"},
+		"bad.com":     {"127.0.0.2"},
+	})
+
+	err := NewMailer(ConnectDirect).Send("Subject!", From("", "me@example.com"),
+		append(To("to@example.com", "to2@example.com"), Cc("cc@example.net")...),
+		Bodyf("Well, hello there!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.messages()); n != 2 {
+		t.Errorf("got %d messages; want 2", n)
+	}
+	var rcpt []string
+	for _, c := range srv.commands() {
+		if strings.HasPrefix(c, "RCPT TO:") {
+			rcpt = append(rcpt, c)
+		}
+	}
+	if len(rcpt) != 3 {
+		t.Errorf("wrong RCPT commands: %q", rcpt)
+	}
+
+	err = NewMailer(ConnectDirect).Send("Subject!", From("", "me@example.com"),
+		To("to@example.com", "to@bad.com"),
+		Bodyf("Well, hello there!"))
+	var dErr DirectError
+	if !errors.As(err, &dErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if got := []string{"bad.com"}; !reflect.DeepEqual(got, keys(dErr)) {
+		t.Errorf("wrong domains in error: %v", dErr)
+	}
+	if n := len(srv.messages()); n != 3 {
+		t.Errorf("got %d messages; want 3", n)
+	}
+}
+
+func TestDirectAddressLiteral(t *testing.T) {
+	srv, addr := startServer(t)
+	useServer(t, addr, nil)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		t.Errorf("looked up MX for %q", domain)
+		return nil, errors.New("no MX")
+	}
+
+	err := NewMailer(ConnectDirect).Send("Subject!", From("", "me@example.com"),
+		To("to@[127.0.0.1]"),
+		Bodyf("Well, hello there!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("got %d messages; want 1", n)
+	}
+}
+
+func TestDirectVerifyTLS(t *testing.T) {
+	srv, addr := startServer(t, "STARTTLS")
+	srv.mu.Lock()
+	srv.tls = selfSignedCert(t, "mx.example.com")
+	srv.mu.Unlock()
+	useServer(t, addr, map[string][]string{"example.com": {"127.0.0.1"}})
+
+	t.Run("opportunistic", func(t *testing.T) {
+		err := NewMailer(ConnectDirect).Send("Subject!", From("", "me@example.com"),
+			To("to@example.com"), Bodyf("Well, hello there!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(srv.messages()); n != 1 {
+			t.Errorf("got %d messages; want 1", n)
+		}
+		if cmds := srv.commands(); len(cmds) < 2 || cmds[1] != "STARTTLS" {
+			t.Errorf("no STARTTLS: %q", cmds)
+		}
+	})
+
+	t.Run("enforce", func(t *testing.T) {
+		err := NewMailer(ConnectDirect, MailerVerifyTLS(true)).Send("Subject!", From("", "me@example.com"),
+			To("to@example.com"), Bodyf("Well, hello there!"))
+		if !ztest.ErrorContains(err, "x509: ") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if n := len(srv.messages()); n != 1 {
+			t.Errorf("got %d messages; want 1", n)
+		}
+	})
+}
+
+func TestDirectHedge(t *testing.T) {
+	srv, addr := startServer(t)
+	useServer(t, addr, map[string][]string{
+		"slow.com": {"127.0.0.2", "127.0.0.1"},
+		"fast.com": {"127.0.0.1", "127.0.0.2"},
+	})
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	d := &net.Dialer{Control: func(network, address string, _ syscall.RawConn) error {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		if strings.HasPrefix(address, "127.0.0.2:") {
+			time.Sleep(2 * time.Second)
+		}
+		return nil
+	}}
+	m := NewMailer(ConnectDirect, MailerDialer(d), MailerHedge(20*time.Millisecond))
+
+	start := time.Now()
+	err := m.Send("Subject!", From("", "me@example.com"), To("to@slow.com"), Bodyf("Well, hello there!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s; didn't use the secondary MX", took)
+	}
+	if n := len(srv.messages()); n != 1 {
+		t.Errorf("got %d messages; want 1", n)
+	}
+
+	mu.Lock()
+	dialed = nil
+	mu.Unlock()
+	err = m.Send("Subject!", From("", "me@example.com"), To("to@fast.com"), Bodyf("Well, hello there!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || !strings.HasPrefix(dialed[0], "127.0.0.1:") {
+		t.Errorf("wrong hosts dialed: %q", dialed)
+	}
+}
+
+// selfSignedCert creates a TLS config with a self-signed certificate for host.
+func selfSignedCert(t *testing.T, host string) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}}
+}
+
+func keys(m map[string]error) []string {
+	k := make([]string, 0, len(m))
+	for kk := range m {
+		k = append(k, kk)
+	}
+	return k
+}
@@ -0,0 +1,49 @@
+package blackmail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"zgo.at/blackmail/smtp"
+)
+
+type senderMaildir struct {
+	dir string
+	n   *uint64 // Delivery counter, for unique names.
+}
+
+// send writes the message to a new file in tmp/ and then moves it to new/, so
+// that readers never see partially written messages.
+func (s senderMaildir) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	name := s.name()
+	tmp := filepath.Join(s.dir, "tmp", name)
+
+	err := os.WriteFile(tmp, bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")), 0o600)
+	if err != nil {
+		return SendResult{}, fmt.Errorf("senderMaildir.send: %w", err)
+	}
+	err = os.Rename(tmp, filepath.Join(s.dir, "new", name))
+	if err != nil {
+		os.Remove(tmp)
+		return SendResult{}, fmt.Errorf("senderMaildir.send: %w", err)
+	}
+	return SendResult{QueueID: name}, nil
+}
+
+// name gets a unique filename in the form "time.M<usec>P<pid>Q<n>.host".
+func (s senderMaildir) name() string {
+	host, err := osHostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	t := now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", t.Unix(), t.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(s.n, 1), host)
+}
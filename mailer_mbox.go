@@ -0,0 +1,49 @@
+package blackmail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"zgo.at/blackmail/smtp"
+)
+
+type senderMbox struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+// send writes the message in the mboxrd format: a "From " line with the
+// envelope sender and date, followed by the message with LF line endings and
+// lines starting with (any number of) ">" and "From " quoted with an extra ">".
+func (s senderMbox) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(len(msg) + 128)
+	fmt.Fprintf(buf, "From %s %s\n", from, now().UTC().Format("Mon Jan _2 15:04:05 2006"))
+
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	for len(msg) > 0 {
+		var line []byte
+		line, msg, _ = bytes.Cut(msg, []byte("\n"))
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	if err != nil {
+		return SendResult{}, fmt.Errorf("senderMbox.send: %w", err)
+	}
+	return SendResult{}, nil
+}
@@ -0,0 +1,123 @@
+package blackmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// dialSOCKS5 connects to addr through the SOCKS5 proxy (RFC 1928), with
+// optional username/password authentication (RFC 1929).
+//
+// The hostname is sent to the proxy as-is, so it's resolved by the proxy rather
+// than locally.
+func dialSOCKS5(ctx context.Context, d *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme != "socks5" && proxy.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("hostname too long: %q", host)
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	err = socks5Handshake(conn, proxy.User, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy %s: %w", proxy.Host, err)
+	}
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	method := byte(0x00) // No authentication
+	if user != nil {
+		method = 0x02 // Username/password
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 5 || resp[1] != method {
+		return errors.New("authentication method not accepted")
+	}
+
+	if user != nil {
+		pw, _ := user.Password()
+		if len(user.Username()) > 255 || len(pw) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pw)))
+		req = append(req, pw...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, followed by the bound address and port.
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("connect failed with code %d", head[1])
+	}
+	var n int
+	switch head[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("invalid address type %d in reply", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
@@ -2,12 +2,16 @@ package blackmail
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"net/mail"
+	"io"
+	"net"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"zgo.at/blackmail/smtp"
 )
@@ -17,28 +21,235 @@ const (
 	AuthLogin   = "login"
 	AuthPlain   = "plain"
 	AuthCramMD5 = "cram-md5"
+	AuthScram   = "scram-sha-256"
 )
 
 type senderRelay struct {
 	mu *sync.Mutex
 
-	smtp       string
-	auth       string
-	tls        *tls.Config
-	requireTLS bool
+	smtp          string
+	auth          string
+	tls           *tls.Config
+	requireTLS    bool
+	requireTLSExt bool
+	noStartTLS    bool
+	progress      func(int64)
+	queueID       func(string) string
+	timeout       time.Duration
+	dialer        *net.Dialer
+	proxy         string
+	keep          *relayConn // Set with MailerKeepAlive().
+	sign          func([]byte) (string, error)
 
 	// Cached
 	host, user, pw string
 }
 
-func (s senderRelay) send(subject string, from mail.Address, rcpt []recipient, firstPart bodyPart, parts ...bodyPart) error {
+func (s senderRelay) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	if s.requireTLSExt {
+		opts = requireTLS(opts)
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	msg, opts, err := s.signMsg(msg, opts)
+	if err != nil {
+		return SendResult{}, fmt.Errorf("senderRelay.send: %w", err)
+	}
+
+	if s.keep != nil {
+		return s.sendKeepAlive(ctx, from, to, msg, opts)
+	}
+
+	c, _, auth, err := s.connect(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return SendResult{}, fmt.Errorf("senderRelay.send: %w", err)
+	}
+	defer c.Close()
+
+	defer closeOnCancel(ctx, c)()
+	res, err := s.deliver(ctx, c, auth, from, to, msg, opts)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return SendResult{}, fmt.Errorf("senderRelay.send: %w", err)
+	}
+	return res, nil
+}
+
+// signMsg adds the header from the MailerSignHeaders() callback to the top of
+// the message.
+func (s senderRelay) signMsg(msg []byte, opts *smtp.MailOptions) ([]byte, *smtp.MailOptions, error) {
+	if s.sign == nil {
+		return msg, opts, nil
+	}
+	h, err := s.sign(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing message: %w", err)
+	}
+	if !strings.HasSuffix(h, "\r\n") {
+		h += "\r\n"
+	}
+	if opts != nil && opts.Size > 0 {
+		mo := *opts
+		mo.Size += len(h)
+		opts = &mo
+	}
+	return append([]byte(h), msg...), opts, nil
+}
+
+// relayConn is a connection that's kept open between messages.
+type relayConn struct {
+	mu   sync.Mutex
+	c    *smtp.Client
+	conn net.Conn // Underlying connection of c, for setting deadlines.
+}
+
+// setDeadline sets the deadline of the connection to the context's deadline,
+// or clears it if the context has no deadline.
+//
+// The connection outlives the context of a single send, so this must be set
+// for every transaction and cleared afterwards.
+func (k *relayConn) setDeadline(ctx context.Context) {
+	if k.conn != nil {
+		d, _ := ctx.Deadline()
+		k.conn.SetDeadline(d)
+	}
+}
+
+// sendKeepAlive sends over the kept-alive connection, connecting if there is
+// no connection yet or if it died. RSET is sent before re-using the connection
+// to clear any state from the previous message.
+func (s senderRelay) sendKeepAlive(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	s.keep.mu.Lock()
+	defer s.keep.mu.Unlock()
+	s.keep.setDeadline(ctx)
+	defer s.keep.setDeadline(context.Background())
+
+	if err := s.keepConn(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return SendResult{}, fmt.Errorf("senderRelay.send: %w", err)
+	}
+
+	stop := closeOnCancel(ctx, s.keep.c)
+	res, err := s.transaction(ctx, s.keep.c, from, to, msg, opts)
+	stop()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return SendResult{}, fmt.Errorf("senderRelay.send: %w", err)
+	}
+	return res, nil
+}
+
+// keepConn makes sure s.keep.c is a usable connection, resetting the existing
+// connection or connecting if needed. The caller must hold s.keep.mu.
+func (s senderRelay) keepConn(ctx context.Context) error {
+	if s.keep.c != nil && s.keep.c.Reset() != nil {
+		s.keep.c.Close()
+		s.keep.c, s.keep.conn = nil, nil
+	}
+	if s.keep.c != nil {
+		return nil
+	}
+
+	c, conn, auth, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.handshake(c, auth)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	s.keep.c, s.keep.conn = c, conn
+	return nil
+}
+
+// close the kept-alive connection, if any.
+func (s senderRelay) close() error {
+	if s.keep == nil {
+		return nil
+	}
+	s.keep.mu.Lock()
+	defer s.keep.mu.Unlock()
+	if s.keep.c == nil {
+		return nil
+	}
+	c := s.keep.c
+	s.keep.c, s.keep.conn = nil, nil
+	err := c.Quit()
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("senderRelay.close: %w", err)
+	}
+	return nil
+}
+
+// closeOnCancel closes the connection if the context is cancelled, which will
+// make any pending reads or writes fail. Call the returned function to stop
+// watching the context.
+func closeOnCancel(ctx context.Context, c *smtp.Client) func() {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// verify that we can connect and authenticate to the relay, without sending
+// anything.
+func (s senderRelay) verify(ctx context.Context) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	c, _, auth, err := s.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("senderRelay.verify: %w", err)
+	}
+	defer c.Close()
+
+	err = s.handshake(c, auth)
+	if err != nil {
+		return fmt.Errorf("senderRelay.verify: %w", err)
+	}
+	err = c.Quit()
+	if err != nil {
+		return fmt.Errorf("senderRelay.verify: %w", err)
+	}
+	return nil
+}
+
+// connect to the relay and send EHLO, returning the client and the underlying
+// connection.
+func (s senderRelay) connect(ctx context.Context) (*smtp.Client, net.Conn, smtp.Auth, error) {
 	if s.host == "" {
 		srv, err := url.Parse(s.smtp)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
 		if srv.Host == "" {
-			return errors.New("blackmail.senderRelay: host empty")
+			return nil, nil, nil, errors.New("blackmail.senderRelay: host empty")
 		}
 
 		s.mu.Lock()
@@ -48,11 +259,6 @@ func (s senderRelay) send(subject string, from mail.Address, rcpt []recipient, f
 		s.mu.Unlock()
 	}
 
-	msg, to, err := message(subject, from, rcpt, firstPart, parts...)
-	if err != nil {
-		return err
-	}
-
 	var auth smtp.Auth
 	if s.user != "" {
 		switch s.auth {
@@ -62,16 +268,211 @@ func (s senderRelay) send(subject string, from mail.Address, rcpt []recipient, f
 			auth = smtp.LoginAuth(s.user, s.pw)
 		case AuthCramMD5:
 			auth = smtp.CramMD5Auth(s.user, s.pw)
+		case AuthScram:
+			auth = smtp.ScramSHA256Auth(s.user, s.pw)
 		default:
-			return fmt.Errorf("senderRelay.send: unknown auth option: %q", s.auth)
+			return nil, nil, nil, fmt.Errorf("unknown auth option: %q", s.auth)
 		}
 	}
 
-	// TODO: use requireTLS
-	// TODO: use tls
-	err = smtp.SendMail(s.host, auth, from.Address, to, bytes.NewReader(msg))
+	if s.requireTLS && s.noStartTLS {
+		return nil, nil, nil, errors.New("can't use both MailerRequireTLS and MailerDisableStartTLS")
+	}
+
+	conn, err := dial(ctx, s.dialer, s.proxy, s.host)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	host, _, _ := net.SplitHostPort(s.host)
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return fmt.Errorf("senderRelay.send: %w", err)
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	err = c.Hello(helloName(conn.LocalAddr()))
+	if err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	return c, conn, auth, nil
+}
+
+// handshake does the STARTTLS and AUTH.
+func (s senderRelay) handshake(c *smtp.Client, auth smtp.Auth) error {
+	if !s.noStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			err := c.StartTLS(s.tls)
+			if err != nil {
+				return err
+			}
+		} else if s.requireTLS {
+			return errors.New("relay doesn't support STARTTLS")
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("relay doesn't support AUTH")
+		}
+		err := c.Auth(auth)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// deliver the message over an established connection.
+func (s senderRelay) deliver(ctx context.Context, c *smtp.Client, auth smtp.Auth, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	err := s.handshake(c, auth)
+	if err != nil {
+		return SendResult{}, err
+	}
+	res, err := s.transaction(ctx, c, from, to, msg, opts)
+	if err != nil {
+		return SendResult{}, err
+	}
+	return res, c.Quit()
+}
+
+// transaction sends the MAIL, RCPT, and DATA commands for one message.
+func (s senderRelay) transaction(ctx context.Context, c *smtp.Client, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	err := c.Mail(from, opts)
+	if err != nil {
+		return SendResult{}, err
+	}
+	for _, addr := range to {
+		err := c.Rcpt(addr)
+		if err != nil {
+			return SendResult{}, err
+		}
+	}
+	return s.data(ctx, c, msg)
+}
+
+// data sends the DATA command and the message.
+func (s senderRelay) data(ctx context.Context, c *smtp.Client, msg []byte) (SendResult, error) {
+	w, err := c.Data()
+	if err != nil {
+		return SendResult{}, err
+	}
+	// Hide bytes.Reader's WriteTo() so it's copied in chunks.
+	_, err = io.Copy(&progressWriter{ctx: ctx, w: w, fn: s.progress},
+		struct{ io.Reader }{bytes.NewReader(msg)})
+	if err != nil {
+		return SendResult{}, err
+	}
+	resp, err := w.CloseWithResponse()
+	if err != nil {
+		return SendResult{}, err
+	}
+	return sendResult(resp, s.queueID), nil
+}
+
+// sendBatch sends the message to all recipients in one transaction, returning
+// the recipients that were rejected rather than aborting on the first one.
+func (s senderRelay) sendBatch(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	if s.requireTLSExt {
+		opts = requireTLS(opts)
+	}
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	msg, opts, err := s.signMsg(msg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("senderRelay.sendBatch: %w", err)
+	}
+
+	errs, err := func() (map[string]error, error) {
+		if s.keep != nil {
+			s.keep.mu.Lock()
+			defer s.keep.mu.Unlock()
+			s.keep.setDeadline(ctx)
+			defer s.keep.setDeadline(context.Background())
+			if err := s.keepConn(ctx); err != nil {
+				return nil, err
+			}
+			defer closeOnCancel(ctx, s.keep.c)()
+			return s.batch(ctx, s.keep.c, from, to, msg, opts)
+		}
+
+		c, _, auth, err := s.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		defer closeOnCancel(ctx, c)()
+
+		err = s.handshake(c, auth)
+		if err != nil {
+			return nil, err
+		}
+		errs, err := s.batch(ctx, c, from, to, msg, opts)
+		if err != nil {
+			return nil, err
+		}
+		return errs, c.Quit()
+	}()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return errs, fmt.Errorf("senderRelay.sendBatch: %w", err)
+	}
+	return errs, nil
+}
+
+// batch runs a mail transaction, sending the message if at least one
+// recipient was accepted.
+func (s senderRelay) batch(ctx context.Context, c *smtp.Client, from string, to []string, msg []byte, opts *smtp.MailOptions) (map[string]error, error) {
+	err := c.Mail(from, opts)
+	if err != nil {
+		return nil, err
+	}
+	rcpts := make([]smtp.RcptWithOptions, len(to))
+	for i := range to {
+		rcpts[i].Addr = to[i]
+	}
+	res, err := c.Rcpts(rcpts)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(map[string]error)
+	for addr, rErr := range res {
+		if rErr != nil {
+			errs[addr] = rErr
+		}
+	}
+	if len(errs) == len(res) { // Everything rejected: nothing to send.
+		return errs, nil
+	}
+	_, err = s.data(ctx, c, msg)
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// progressWriter calls fn with the total number of bytes written after every
+// write, and stops writing if the context is cancelled.
+type progressWriter struct {
+	ctx context.Context
+	w   io.Writer
+	fn  func(int64)
+	n   int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	if w.fn != nil {
+		w.fn(w.n)
+	}
+	return n, err
+}
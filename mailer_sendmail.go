@@ -0,0 +1,39 @@
+package blackmail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"zgo.at/blackmail/smtp"
+)
+
+type senderSendmail struct {
+	path string
+	args []string
+}
+
+// send pipes the message to the sendmail binary, with the envelope sender as
+// -f and the recipients as arguments.
+//
+// -i is added so that a line with just a "." doesn't end the message.
+func (s senderSendmail) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	args := append(append([]string{}, s.args...), "-i", "-f", from, "--")
+	args = append(args, to...)
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, s.path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return SendResult{}, fmt.Errorf("senderSendmail.send: running %s: %w: %s", s.path, err, out)
+		}
+		return SendResult{}, fmt.Errorf("senderSendmail.send: running %s: %w", s.path, err)
+	}
+	return SendResult{}, nil
+}
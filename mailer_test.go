@@ -2,14 +2,35 @@ package blackmail
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"zgo.at/blackmail/internal/ztest"
+	"zgo.at/blackmail/smtp"
 )
 
 var (
 	_ sender = senderWriter{}
 	_ sender = senderRelay{}
 	_ sender = senderDirect{}
+	_ sender = senderMbox{}
+	_ sender = senderMaildir{}
+	_ sender = senderSendmail{}
 )
 
 func TestMailerStdout(t *testing.T) {
@@ -27,7 +48,7 @@ func TestMailerStdout(t *testing.T) {
 			To("Name", "addr"),
 			Bodyf("Well, hello there!"))
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -39,7 +60,7 @@ func TestMailerStdout(t *testing.T) {
 			To("Name", "addr"),
 			Bodyf("Well, hello there!"))
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -50,3 +71,632 @@ func TestMailerStdout(t *testing.T) {
 		t.Errorf("short output length")
 	}
 }
+
+func TestMbox(t *testing.T) {
+	now = func() time.Time { return time.Date(2019, 6, 18, 13, 37, 00, 123456789, time.UTC) }
+	buf := new(bytes.Buffer)
+	m := NewMailerMbox(buf)
+
+	for _, subj := range []string{"First", "Second"} {
+		err := m.Send(subj, From("", "me@example.com"), To("to@example.com"),
+			Bodyf("Hello\nFrom here\n>From there\nFrom"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "From me@example.com Tue Jun 18 13:37:00 2019\n") {
+		t.Errorf("wrong From line:\n%s", out)
+	}
+
+	msgs := strings.Split(out, "\n\nFrom me@example.com ")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages:\n%s", len(msgs), out)
+	}
+	for i, subj := range []string{"First", "Second"} {
+		_, raw, _ := strings.Cut(msgs[i], "\n")
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Header.Get("Subject"); got != subj {
+			t.Errorf("wrong subject: %q", got)
+		}
+		body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+		if want := "Hello\n>From here\n>>From there\nFrom"; strings.TrimRight(string(body), "\n") != want {
+			t.Errorf("\ngot:  %q\nwant: %q", body, want)
+		}
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	m, err := NewMailerMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subj := range []string{"First", "Second"} {
+		err := m.Send(subj, From("", "me@example.com"), To("to@example.com"), Bodyf("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := m.Deliver("me@example.com", []string{"to@example.com"}, []byte("Subject: Third\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := func(d string) []string {
+		t.Helper()
+		e, err := os.ReadDir(filepath.Join(dir, d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := make([]string, 0, len(e))
+		for _, f := range e {
+			n = append(n, f.Name())
+		}
+		return n
+	}
+	if tmp, cur := ls("tmp"), ls("cur"); len(tmp) != 0 || len(cur) != 0 {
+		t.Errorf("files in tmp or cur: %q, %q", tmp, cur)
+	}
+
+	files := ls("new")
+	if len(files) != 3 {
+		t.Fatalf("got %d files in new: %q", len(files), files)
+	}
+	var subjects []string
+	for _, f := range files {
+		fp, err := os.Open(filepath.Join(dir, "new", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(fp)
+		fp.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, msg.Header.Get("Subject"))
+	}
+	sort.Strings(subjects)
+	if want := []string{"First", "Second", "Third"}; !reflect.DeepEqual(subjects, want) {
+		t.Errorf("wrong subjects: %q", subjects)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new", res.QueueID)); err != nil {
+		t.Errorf("QueueID %q: %s", res.QueueID, err)
+	}
+}
+
+func TestSendmail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		err := os.WriteFile(p, []byte("#!/bin/sh\n"+body), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	ok := script("sendmail", `echo "$@" > "$(dirname "$0")/args"; cat > "$(dirname "$0")/stdin"`)
+	raw := []byte("Subject: Hello\r\n\r\n.\r\nHello\r\n")
+	_, err := NewMailerSendmail(ok, "-oi").Deliver("me@example.com",
+		[]string{"to@example.com", "cc@example.com"}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "stdin")); !bytes.Equal(got, raw) {
+		t.Errorf("wrong stdin:\n%q", got)
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args"))
+	if want := "-oi -i -f me@example.com -- to@example.com cc@example.com\n"; string(args) != want {
+		t.Errorf("wrong args\ngot:  %q\nwant: %q", args, want)
+	}
+
+	fail := script("fail", `cat > /dev/null; echo "no such user" >&2; exit 67`)
+	err = NewMailerSendmail(fail).Send("Hello", From("", "me@example.com"), To("to@example.com"), Bodyf("Hello"))
+	if !ztest.ErrorContains(err, "exit status 67: no such user") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestSendHTML(t *testing.T) {
+	buf := new(bytes.Buffer)
+	defer func(m Mailer) { DefaultMailer = m }(DefaultMailer)
+	DefaultMailer = NewMailer(ConnectWriter, MailerOut(buf))
+
+	err := SendHTML("Subject!", From("My name", "myemail@example.com"),
+		To("to@example.com"),
+		[]byte("Well, hello there!"),
+		[]byte("<p>Well, hello there!</p>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"Content-Type: multipart/alternative;",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nWell, hello there!",
+		"Content-Type: text/html; charset=utf-8\r\n\r\n<p>Well, hello there!</p>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	start := time.Date(2020, 6, 18, 13, 14, 15, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	buf := new(bytes.Buffer)
+	m := MailerIdempotent(NewMailer(ConnectWriter, MailerOut(buf)), time.Minute)
+	send := func() {
+		t.Helper()
+		err := m.SendIdempotent("event-1", "Subject!", From("", "me@example.com"),
+			To("to@example.com"), Bodyf("Well, hello there!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send()
+	now = func() time.Time { return start.Add(30 * time.Second) }
+	send()
+	if n := strings.Count(buf.String(), "Message-Id:"); n != 1 {
+		t.Errorf("sent %d messages within window; want 1", n)
+	}
+
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	send()
+	if n := strings.Count(buf.String(), "Message-Id:"); n != 2 {
+		t.Errorf("sent %d messages after window; want 2", n)
+	}
+}
+
+func TestRing(t *testing.T) {
+	m := NewMailerRing(NewMailer(ConnectWriter, MailerOut(io.Discard)), 2)
+	if r := m.Recent(); len(r) != 0 {
+		t.Errorf("not empty: %v", r)
+	}
+
+	for _, subj := range []string{"one", "two", "three"} {
+		err := m.Send(subj, From("", "me@example.com"), To("to@example.com"), Bodyf("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := m.Recent()
+	if len(r) != 2 {
+		t.Fatalf("len %d", len(r))
+	}
+	for i, want := range []string{"Subject: two\r\n", "Subject: three\r\n"} {
+		if !bytes.Contains(r[i].Msg, []byte(want)) {
+			t.Errorf("message %d doesn't contain %q:\n%s", i, want, r[i].Msg)
+		}
+		if r[i].From != "me@example.com" || !reflect.DeepEqual(r[i].To, []string{"to@example.com"}) || r[i].Err != nil {
+			t.Errorf("wrong message %d: %#v", i, r[i])
+		}
+	}
+
+	// Slices passed to Deliver() are copied.
+	to, raw := []string{"to@example.com"}, []byte("Subject: raw\r\n\r\nHello\r\n")
+	if _, err := m.Deliver("me@example.com", to, raw); err != nil {
+		t.Fatal(err)
+	}
+	to[0], raw[0] = "changed@example.com", 'X'
+	r = m.Recent()
+	if got := r[len(r)-1]; got.To[0] != "to@example.com" || got.Msg[0] != 'S' {
+		t.Errorf("modified after Deliver(): %#v", got)
+	}
+
+	// Negative n doesn't panic.
+	m = NewMailerRing(NewMailer(ConnectWriter, MailerOut(io.Discard)), -1)
+	if err := m.Send("one", From("", "me@example.com"), To("to@example.com"), Bodyf("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if r := m.Recent(); len(r) != 0 {
+		t.Errorf("not empty: %v", r)
+	}
+}
+
+func TestMailerHeaders(t *testing.T) {
+	buf := new(bytes.Buffer)
+	m := NewMailerHeaders(NewMailer(ConnectWriter, MailerOut(buf)),
+		"X-Environment", "prod", "list-id", "<list.example.com>")
+	m = NewMailerRetry(m, 1, nil) // Should keep the headers.
+
+	err := m.Send("Subject", From("", "me@example.com"), To("to@example.com"), Bodyf("Hello"),
+		Headers("List-Id", "<other.example.com>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf.String()
+	if !strings.Contains(msg, "\r\nX-Environment: prod\r\n") {
+		t.Errorf("no X-Environment header:\n%s", msg)
+	}
+	if !strings.Contains(msg, "\r\nList-Id: <other.example.com>\r\n") || strings.Contains(msg, "list.example.com") {
+		t.Errorf("List-Id not overridden:\n%s", msg)
+	}
+
+	err = NewMailerHeaders(NewMailer(ConnectWriter, MailerOut(buf)), "X-Environment").
+		Send("Subject", From("", "me@example.com"), To("to@example.com"), Bodyf("Hello"))
+	if !ztest.ErrorContains(err, "blackmail.NewMailerHeaders: odd argument count") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// stubSender returns the errors in order, and then nil.
+type stubSender struct {
+	mu    *sync.Mutex
+	errs  []error
+	calls *int
+	delay time.Duration
+}
+
+func (s stubSender) send(ctx context.Context, from string, to []string, msg []byte, opts *smtp.MailOptions) (SendResult, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.calls++
+	if *s.calls <= len(s.errs) {
+		return SendResult{}, s.errs[*s.calls-1]
+	}
+	return SendResult{QueueID: "42"}, nil
+}
+
+func TestRetry(t *testing.T) {
+	var (
+		temp = fmt.Errorf("senderRelay.send: %w", &smtp.SMTPError{Code: 451, Message: "try again"})
+		perm = fmt.Errorf("senderRelay.send: %w", &smtp.SMTPError{Code: 550, Message: "no such user"})
+	)
+	tests := []struct {
+		errs      []error
+		attempts  int
+		wantCalls int
+		wantErr   string
+	}{
+		{nil, 3, 1, ""},
+		{[]error{temp, temp}, 3, 3, ""},
+		{[]error{temp, SoftError{errors.New("connection reset")}}, 3, 3, ""},
+		{[]error{temp, temp, temp}, 3, 3, "try again"},
+		{[]error{perm}, 3, 1, "no such user"},
+		{[]error{temp, perm}, 3, 2, "no such user"},
+		{[]error{DirectError{"example.com": temp}}, 3, 1, "example.com: senderRelay.send: try again"},
+		{[]error{errors.New("oh noes")}, 3, 1, "oh noes"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			var (
+				calls   int
+				backoff []int
+			)
+			m := NewMailerRetry(Mailer{sender: stubSender{mu: new(sync.Mutex), errs: tt.errs, calls: &calls}},
+				tt.attempts, func(a int) time.Duration {
+					backoff = append(backoff, a)
+					return time.Millisecond
+				})
+			res, err := m.Deliver("me@example.com", []string{"to@example.com"}, []byte("Subject: x\r\n\r\nx"))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if err == nil && res.QueueID != "42" {
+				t.Errorf("wrong result: %#v", res)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls; want %d", calls, tt.wantCalls)
+			}
+			if len(backoff) != tt.wantCalls-1 {
+				t.Errorf("backoff called with %v", backoff)
+			}
+		})
+	}
+
+	t.Run("context", func(t *testing.T) {
+		var calls int
+		ctx, cancel := context.WithCancel(context.Background())
+		m := NewMailerRetry(Mailer{sender: stubSender{mu: new(sync.Mutex), errs: []error{temp, temp}, calls: &calls}},
+			3, func(int) time.Duration { cancel(); return time.Hour })
+		_, err := m.DeliverContext(ctx, "me@example.com", []string{"to@example.com"}, []byte("Subject: x\r\n\r\nx"))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if calls != 1 {
+			t.Errorf("%d calls", calls)
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	start := time.Date(2019, 6, 18, 13, 37, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	deliver := func(m Mailer) error {
+		_, err := m.Deliver("me@example.com", []string{"to@example.com"}, []byte("Subject: x\r\n\r\nx"))
+		return err
+	}
+
+	t.Run("volume", func(t *testing.T) {
+		now = func() time.Time { return start }
+		var calls int
+		m := NewMailerCircuitBreaker(Mailer{sender: stubSender{mu: new(sync.Mutex), calls: &calls}},
+			CircuitBreaker{Window: time.Minute, Cooldown: 10 * time.Minute, MaxSends: 3})
+
+		for i := 0; i < 3; i++ {
+			if err := deliver(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := deliver(m); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("wrong error: %v", err)
+		}
+
+		// Still open after the window, but before the cooldown.
+		now = func() time.Time { return start.Add(5 * time.Minute) }
+		if err := deliver(m); !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if calls != 3 {
+			t.Errorf("%d calls", calls)
+		}
+
+		// Recovered.
+		now = func() time.Time { return start.Add(11 * time.Minute) }
+		if err := deliver(m); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 4 {
+			t.Errorf("%d calls", calls)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		now = func() time.Time { return start }
+		var calls int
+		m := NewMailerCircuitBreaker(Mailer{sender: stubSender{mu: new(sync.Mutex), calls: &calls, delay: 50 * time.Millisecond}},
+			CircuitBreaker{Window: time.Minute, Cooldown: 10 * time.Minute, MaxSends: 5})
+
+		var (
+			wg   sync.WaitGroup
+			open int32
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := deliver(m); errors.Is(err, ErrCircuitOpen) {
+					atomic.AddInt32(&open, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if calls != 5 {
+			t.Errorf("%d calls", calls)
+		}
+		if open != 45 {
+			t.Errorf("%d sends blocked", open)
+		}
+	})
+
+	t.Run("error rate", func(t *testing.T) {
+		now = func() time.Time { return start }
+		var (
+			calls int
+			fail  = errors.New("fail")
+		)
+		m := NewMailerCircuitBreaker(Mailer{sender: stubSender{mu: new(sync.Mutex), errs: []error{nil, fail, fail}, calls: &calls}},
+			CircuitBreaker{Window: time.Minute, Cooldown: time.Minute, MaxErrorRate: 0.5, MinSends: 3})
+
+		for i, want := range []error{nil, fail, fail, ErrCircuitOpen} {
+			if err := deliver(m); !errors.Is(err, want) {
+				t.Fatalf("send %d: wrong error: %v", i, err)
+			}
+		}
+		if calls != 3 {
+			t.Errorf("%d calls", calls)
+		}
+
+		now = func() time.Time { return start.Add(time.Minute) }
+		if err := deliver(m); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBalancer(t *testing.T) {
+	defer func() { now = func() time.Time { return time.Now() } }()
+	start := time.Date(2019, 6, 18, 13, 37, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	var (
+		calls = make([]int, 3)
+		fail  = errors.New("fail")
+	)
+	m := NewMailerBalancer(
+		Mailer{sender: stubSender{mu: new(sync.Mutex), calls: &calls[0]}},
+		Mailer{sender: stubSender{mu: new(sync.Mutex), errs: []error{fail}, calls: &calls[1]}},
+		Mailer{sender: stubSender{mu: new(sync.Mutex), calls: &calls[2]}},
+	)
+	deliver := func() error {
+		_, err := m.Deliver("me@example.com", []string{"to@example.com"}, []byte("Subject: x\r\n\r\nx"))
+		return err
+	}
+
+	for i, want := range []error{nil, fail, nil, nil, nil, nil} {
+		if err := deliver(); !errors.Is(err, want) {
+			t.Fatalf("send %d: wrong error: %v", i, err)
+		}
+	}
+	// The second one is skipped after it failed.
+	if want := []int{3, 1, 2}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("\ngot:  %v\nwant: %v", calls, want)
+	}
+
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	if err := deliver(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 2, 2}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("\ngot:  %v\nwant: %v", calls, want)
+	}
+}
+
+func TestPreflightCheck(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupTXT = f }(lookupTXT)
+
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	tests := []struct {
+		selector string
+		txt      []string
+		err      error
+		dkim     []string
+		dkimErr  error
+		want     []string
+	}{
+		{"sel", []string{"v=spf1 mx -all"}, nil, []string{"v=DKIM1; k=rsa; p=MIIBIjAN"}, nil, nil},
+		{"", []string{"v=spf1 mx -all"}, nil, nil, nil, []string{"dkim"}},
+		{"sel", []string{"v=spf1 mx -all"}, nil, nil, notFound, []string{"dkim"}},
+		{"sel", []string{"v=spf1 mx -all"}, nil, []string{"v=DKIM1; p="}, nil, []string{"dkim"}},
+		{"sel", []string{"v=spf1 mx -all"}, nil, nil, errors.New("oh noes"), []string{"dkim"}},
+		{"sel", []string{"google-site-verification=xxx"}, nil, []string{"p=MIIB"}, nil, []string{"spf"}},
+		{"sel", nil, notFound, []string{"p=MIIB"}, nil, []string{"spf"}},
+		{"sel", nil, errors.New("oh noes"), []string{"p=MIIB"}, nil, []string{"spf"}},
+		{"", nil, notFound, nil, nil, []string{"spf", "dkim"}},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			lookupTXT = func(name string) ([]string, error) {
+				switch name {
+				case "example.com":
+					return tt.txt, tt.err
+				case "sel._domainkey.example.com":
+					return tt.dkim, tt.dkimErr
+				}
+				t.Errorf("wrong name: %q", name)
+				return nil, notFound
+			}
+
+			var got []string
+			for _, w := range NewMailer(ConnectDirect).PreflightCheck("example.com", tt.selector) {
+				got = append(got, w.Check)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %v\nwant: %v", got, tt.want)
+			}
+		})
+	}
+
+	if w := NewMailer(ConnectWriter).PreflightCheck("example.com", "sel"); w != nil {
+		t.Errorf("not nil for writer mailer: %v", w)
+	}
+
+	t.Run("wrapped", func(t *testing.T) {
+		lookupTXT = func(string) ([]string, error) { return nil, notFound }
+
+		direct := NewMailer(ConnectDirect)
+		for _, m := range []Mailer{
+			NewMailerRetry(direct, 3, nil),
+			NewMailerCircuitBreaker(direct, CircuitBreaker{MaxSends: 10}),
+			NewMailerRing(direct, 10).Mailer,
+			NewMailerBalancer(direct, NewMailer(ConnectWriter)),
+		} {
+			if w := m.PreflightCheck("example.com", "sel"); len(w) != 2 {
+				t.Errorf("%T: wrong warnings: %v", m.sender, w)
+			}
+		}
+	})
+
+	t.Run("MailerPreflight", func(t *testing.T) {
+		defer func(w io.Writer) { stderr = w }(stderr)
+		buf := new(bytes.Buffer)
+		stderr = buf
+		lookupTXT = func(string) ([]string, error) { return nil, notFound }
+
+		NewMailer(ConnectDirect, MailerPreflight("example.com", "sel"))
+		want := `blackmail.NewMailer: preflight check for "example.com": spf: no SPF record for "example.com"; many servers will reject or junk the email
+blackmail.NewMailer: preflight check for "example.com": dkim: no DKIM key for "sel._domainkey.example.com"; many servers will reject or junk the email
+`
+		if buf.String() != want {
+			t.Errorf("\ngot:\n%s\nwant:\n%s", buf.String(), want)
+		}
+	})
+}
+
+func TestDirectHosts(t *testing.T) {
+	defer func(f func(string) ([]*net.MX, error)) { lookupMX = f }(lookupMX)
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if strings.HasPrefix(domain, "[") {
+			t.Errorf("looked up MX for address literal %q", domain)
+		}
+		return []*net.MX{{Host: "mx1." + domain, Pref: 10}}, nil
+	}
+
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{"example.com", []string{"mx1.example.com"}, ""},
+		{"[192.0.2.1]", []string{"192.0.2.1"}, ""},
+		{"[IPv6:2001:db8::1]", []string{"2001:db8::1"}, ""},
+		{"[ipv6:2001:DB8::1]", []string{"2001:db8::1"}, ""},
+		{"[2001:db8::1]", nil, "invalid address literal"},
+		{"[IPv6:192.0.2.1]", nil, "invalid address literal"},
+		{"[192.0.2.300]", nil, "invalid address literal"},
+		{"[]", nil, "invalid address literal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := senderDirect{}.hosts(tt.in)
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("\ngot:  %v\nwant: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelloName(t *testing.T) {
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+
+	tests := []struct {
+		hostname string
+		err      error
+		local    net.Addr
+		want     string
+	}{
+		{"mail.example.com", nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}, "mail.example.com"},
+		{"mail.example.com.", nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}, "mail.example.com."},
+		{"myhost", nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}, "[192.0.2.10]"},
+		{"myhost.", nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}, "[192.0.2.10]"},
+		{"", errors.New("oh noes"), &net.TCPAddr{IP: net.ParseIP("192.0.2.10")}, "[192.0.2.10]"},
+		{"myhost", nil, &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, "[IPv6:2001:db8::1]"},
+		{"myhost", nil, nil, "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			osHostname = func() (string, error) { return tt.hostname, tt.err }
+			got := helloName(tt.local)
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
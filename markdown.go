@@ -0,0 +1,231 @@
+//go:build !blackmail_no_markdown
+// +build !blackmail_no_markdown
+
+package blackmail
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// BodyMarkdown returns a new multipart/alternative part with src as the
+// text/plain part and the rendered HTML as the text/html part.
+//
+// Any images are added to the HTML part as with BodyHTML(); use
+// ![alt](cid:blackmail:1) to refer to them.
+//
+// This supports a fairly small subset of Markdown: paragraphs, headings, lists,
+// block quotes, code blocks, horizontal rules, and inline emphasis, code,
+// links, and images. Raw HTML is escaped.
+//
+// The renderer can be excluded with the blackmail_no_markdown build tag.
+func BodyMarkdown(src []byte, images ...bodyPart) bodyPart {
+	return bodyPart{
+		ct:    "multipart/alternative",
+		parts: []bodyPart{BodyText(src), BodyHTML(markdown(src), images...)},
+	}
+}
+
+var (
+	reHeading = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	reUL      = regexp.MustCompile(`^ {0,3}[-*+][ \t]+`)
+	reOL      = regexp.MustCompile(`^ {0,3}\d{1,9}[.)][ \t]+`)
+)
+
+func markdown(src []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n")
+	b := new(strings.Builder)
+	mdBlocks(b, lines)
+	return []byte(b.String())
+}
+
+func mdIsBlank(l string) bool { return strings.TrimSpace(l) == "" }
+
+func mdIsHR(l string) bool {
+	l = strings.NewReplacer(" ", "", "\t", "").Replace(l)
+	return len(l) >= 3 && strings.Trim(l, l[:1]) == "" && strings.Contains("-*_", l[:1])
+}
+
+func mdIsCode(l string) bool {
+	return strings.HasPrefix(l, "    ") || strings.HasPrefix(l, "\t")
+}
+
+// mdStartsBlock reports if the line starts a block that interrupts a
+// paragraph.
+func mdStartsBlock(l string) bool {
+	return reHeading.MatchString(l) || mdIsHR(l) || reUL.MatchString(l) ||
+		reOL.MatchString(l) || strings.HasPrefix(strings.TrimLeft(l, " "), ">") ||
+		strings.HasPrefix(strings.TrimLeft(l, " "), "```")
+}
+
+func mdBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		switch {
+		case mdIsBlank(l):
+			i++
+
+		case strings.HasPrefix(strings.TrimLeft(l, " "), "```"):
+			i++
+			b.WriteString("<pre><code>")
+			for ; i < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[i], " "), "```"); i++ {
+				b.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+			i++
+
+		case mdIsCode(l):
+			var code []string
+			for ; i < len(lines) && (mdIsCode(lines[i]) || mdIsBlank(lines[i])); i++ {
+				code = append(code, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    "))
+			}
+			for len(code) > 0 && mdIsBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+
+		case reHeading.MatchString(l):
+			m := reHeading.FindStringSubmatch(l)
+			n := string(rune('0' + len(m[1])))
+			b.WriteString("<h" + n + ">" + mdInline(m[2]) + "</h" + n + ">\n")
+			i++
+
+		case mdIsHR(l):
+			b.WriteString("<hr>\n")
+			i++
+
+		case strings.HasPrefix(strings.TrimLeft(l, " "), ">"):
+			var quote []string
+			for ; i < len(lines) && !mdIsBlank(lines[i]); i++ {
+				q := strings.TrimLeft(lines[i], " ")
+				q = strings.TrimPrefix(q, ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			b.WriteString("<blockquote>\n")
+			mdBlocks(b, quote)
+			b.WriteString("</blockquote>\n")
+
+		case reUL.MatchString(l), reOL.MatchString(l):
+			re, tag := reUL, "ul"
+			if reOL.MatchString(l) {
+				re, tag = reOL, "ol"
+			}
+			var items []string
+			for ; i < len(lines) && !mdIsBlank(lines[i]); i++ {
+				if m := re.FindString(lines[i]); m != "" {
+					items = append(items, lines[i][len(m):])
+					continue
+				}
+				if mdStartsBlock(lines[i]) {
+					break
+				}
+				items[len(items)-1] += "\n" + strings.TrimSpace(lines[i])
+			}
+			b.WriteString("<" + tag + ">\n")
+			for _, it := range items {
+				b.WriteString("<li>" + mdInline(it) + "</li>\n")
+			}
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			para := []string{strings.TrimSpace(l)}
+			for i++; i < len(lines) && !mdIsBlank(lines[i]) && !mdStartsBlock(lines[i]); i++ {
+				para = append(para, strings.TrimSpace(lines[i]))
+			}
+			b.WriteString("<p>" + mdInline(strings.Join(para, "\n")) + "</p>\n")
+		}
+	}
+}
+
+// mdLink parses "[text](url)" at the start of s, returning the text, url, and
+// length of the match.
+func mdLink(s string) (string, string, int) {
+	if len(s) == 0 || s[0] != '[' {
+		return "", "", 0
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if i+1 >= len(s) || s[i+1] != '(' {
+				return "", "", 0
+			}
+			end := strings.IndexByte(s[i+2:], ')')
+			if end == -1 {
+				return "", "", 0
+			}
+			return s[1:i], strings.TrimSpace(s[i+2 : i+2+end]), i + 3 + end
+		}
+	}
+	return "", "", 0
+}
+
+func mdInline(s string) string {
+	b := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#+-.!<>", s[i+1]) > -1:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i++
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > -1 {
+				b.WriteString("<code>" + html.EscapeString(s[i+1:i+1+end]) + "</code>")
+				i += end + 1
+				continue
+			}
+
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if alt, src, n := mdLink(s[i+1:]); n > 0 {
+				b.WriteString(`<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `">`)
+				i += n
+				continue
+			}
+
+		case c == '[':
+			if text, href, n := mdLink(s[i:]); n > 0 {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `">` + mdInline(text) + `</a>`)
+				i += n - 1
+				continue
+			}
+
+		case c == '<':
+			if end := strings.IndexByte(s[i:], '>'); end > -1 {
+				u := s[i+1 : i+end]
+				if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "mailto:") {
+					u = html.EscapeString(u)
+					b.WriteString(`<a href="` + u + `">` + strings.TrimPrefix(u, "mailto:") + `</a>`)
+					i += end
+					continue
+				}
+			}
+
+		case c == '*' || (c == '_' && (i == 0 || !mdIsWord(s[i-1]))):
+			delim, tag := s[i:i+1], "em"
+			if i+1 < len(s) && s[i+1] == c {
+				delim, tag = s[i:i+2], "strong"
+			}
+			rest := s[i+len(delim):]
+			if end := strings.Index(rest, delim); end > 0 && rest[0] != ' ' {
+				b.WriteString("<" + tag + ">" + mdInline(rest[:end]) + "</" + tag + ">")
+				i += len(delim)*2 + end - 1
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[i : i+1]))
+	}
+	return b.String()
+}
+
+func mdIsWord(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
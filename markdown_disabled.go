@@ -0,0 +1,12 @@
+//go:build blackmail_no_markdown
+// +build blackmail_no_markdown
+
+package blackmail
+
+import "errors"
+
+// BodyMarkdown is disabled with the blackmail_no_markdown build tag; it always
+// returns an error.
+func BodyMarkdown(src []byte, images ...bodyPart) bodyPart {
+	return bodyPart{err: errors.New("blackmail.BodyMarkdown: compiled with blackmail_no_markdown")}
+}
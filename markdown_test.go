@@ -0,0 +1,70 @@
+//go:build !blackmail_no_markdown
+// +build !blackmail_no_markdown
+
+package blackmail
+
+import (
+	"strings"
+	"testing"
+
+	"zgo.at/blackmail/internal/ztest/image"
+)
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Hello", "<p>Hello</p>\n"},
+		{"Hello\nworld\r\n\r\nNext", "<p>Hello\nworld</p>\n<p>Next</p>\n"},
+		{"# Title #\n## Sub", "<h1>Title</h1>\n<h2>Sub</h2>\n"},
+		{"a *em* **strong** _em_ snake_case `<code>`",
+			"<p>a <em>em</em> <strong>strong</strong> <em>em</em> snake_case <code>&lt;code&gt;</code></p>\n"},
+		{"<b>x</b> & \\*", "<p>&lt;b&gt;x&lt;/b&gt; &amp; *</p>\n"},
+		{"[a *link*](https://example.com?a=1&b=2) <https://x.com>",
+			`<p><a href="https://example.com?a=1&amp;b=2">a <em>link</em></a> <a href="https://x.com">https://x.com</a></p>` + "\n"},
+		{"![alt](cid:blackmail:1)", `<p><img src="cid:blackmail:1" alt="alt"></p>` + "\n"},
+		{"- one\n- two\n  more\n* three", "<ul>\n<li>one</li>\n<li>two\nmore</li>\n<li>three</li>\n</ul>\n"},
+		{"Text\n1. one\n2) two", "<p>Text</p>\n<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+		{"> quote\n> # head", "<blockquote>\n<p>quote</p>\n<h1>head</h1>\n</blockquote>\n"},
+		{"```\n<x>\n  y\n```\nafter", "<pre><code>&lt;x&gt;\n  y\n</code></pre>\n<p>after</p>\n"},
+		{"    code\n\n    more\n\npara", "<pre><code>code\n\nmore\n</code></pre>\n<p>para</p>\n"},
+		{"---\n* * *", "<hr>\n<hr>\n"},
+		{"a * b * c", "<p>a * b * c</p>\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := string(markdown([]byte(tt.in)))
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyMarkdown(t *testing.T) {
+	msg, _, err := Message("Markdown", From("", "me@example.com"), To("to@to.to"),
+		BodyMarkdown([]byte("Hello *there*\n\n![img](cid:blackmail:1)"),
+			InlineImage("image/png", "img.png", image.PNG)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := string(msg)
+	for _, want := range []string{
+		"Mime-Version: 1.0\r\nContent-Type: multipart/alternative;",
+		"Content-Type: multipart/related;",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nHello *there*",
+		"<p>Hello <em>there</em></p>",
+		`<img src=3D"cid:`,
+		"Content-Id: <",
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("no %q in message:\n%s", want, m)
+		}
+	}
+	if n := strings.Count(m, "multipart/alternative"); n != 1 {
+		t.Errorf("multipart/alternative %d times in message:\n%s", n, m)
+	}
+}
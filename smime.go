@@ -0,0 +1,227 @@
+//go:build !blackmail_no_smime
+// +build !blackmail_no_smime
+
+package blackmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// SignSMIME signs the message with S/MIME (RFC 8551), using the certificate
+// and private key in cert.
+//
+// The body is wrapped in a multipart/signed part, with the detached PKCS #7
+// signature in an smime.p7s attachment. All certificates in cert are included
+// in the signature, so add any intermediate certificates to it.
+//
+// Only RSA and ECDSA keys are supported. This is done before DKIM(), and
+// nothing in the message should be changed after this.
+//
+// This can be excluded with the blackmail_no_smime build tag.
+func SignSMIME(cert tls.Certificate) bodyPart {
+	return bodyPart{ct: "OPTION", opt: func(o *msgOpts) { o.smime = &cert }}
+}
+
+// smimeSign moves the Content-Type and Content-Transfer-Encoding headers and
+// the body of msg to a multipart/signed part, and adds the signature.
+func smimeSign(msg []byte, cert tls.Certificate, hashBoundary bool) ([]byte, error) {
+	head, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("blackmail.SignSMIME: no blank line after the header")
+	}
+
+	var outer, inner []string
+	for _, f := range dkimFields(head) {
+		switch f.name {
+		case "mime-version":
+		case "content-type", "content-transfer-encoding":
+			inner = append(inner, f.raw)
+		default:
+			outer = append(outer, f.raw)
+		}
+	}
+	entity := append([]byte(strings.Join(inner, "\r\n")+"\r\n\r\n"), body...)
+
+	sig, err := pkcs7Sign(entity, cert)
+	if err != nil {
+		return nil, fmt.Errorf("blackmail.SignSMIME: %w", err)
+	}
+
+	var b string
+	if hashBoundary {
+		h := sha256.Sum256(entity)
+		b = fmt.Sprintf("%x", h[:30])
+	} else {
+		b, err = randomBoundary()
+		if err != nil {
+			return nil, fmt.Errorf("blackmail.SignSMIME: %w", err)
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(msg)+len(sig)*2))
+	for _, h := range outer {
+		out.WriteString(h + "\r\n")
+	}
+	out.WriteString("Mime-Version: 1.0\r\n")
+	fmt.Fprintf(out, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\";\r\n\tmicalg=sha-256; boundary=\"%s\"\r\n\r\n", b)
+	fmt.Fprintf(out, "--%s\r\n", b)
+	out.Write(entity)
+	fmt.Fprintf(out, "\r\n--%s\r\n", b)
+	out.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	out.WriteString("Content-Transfer-Encoding: base64\r\n")
+	out.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	bw := newBase64Writer(out, 76)
+	bw.Write(sig)
+	bw.Close()
+	fmt.Fprintf(out, "\r\n--%s--\r\n", b)
+	return out.Bytes(), nil
+}
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// PKCS #7 / CMS structures (RFC 5652); only what's needed for a detached
+// signature with one signer.
+type (
+	pkcs7ContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+
+	pkcs7SignedData struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      pkcs7EncapContentInfo
+		Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+		SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+	}
+
+	// Without eContent, as the signature is detached.
+	pkcs7EncapContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+	}
+
+	pkcs7SignerInfo struct {
+		Version            int
+		IssuerAndSerial    pkcs7IssuerAndSerial
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	}
+
+	pkcs7IssuerAndSerial struct {
+		Issuer asn1.RawValue
+		Serial *big.Int
+	}
+
+	pkcs7Attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	}
+)
+
+// pkcs7Sign creates a detached PKCS #7 SignedData signature for content.
+func pkcs7Sign(content []byte, cert tls.Certificate) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key is a %T, which can't sign", cert.PrivateKey)
+	}
+	var sigAlg pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSASHA256}
+	default:
+		return nil, fmt.Errorf("private key is a %T; only RSA and ECDSA keys are supported", key.Public())
+	}
+
+	// The signature is over the signed attributes, which include the digest of
+	// the content. They're signed as a SET OF, but included as [0] IMPLICIT.
+	digest := sha256.Sum256(content)
+	attrs, err := pkcs7Attributes(
+		oidContentType, oidData,
+		oidMessageDigest, digest[:],
+		oidSigningTime, now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(attrs)
+	sig, err := key.Sign(RandSource, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sha := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha},
+		ContentInfo:      pkcs7EncapContentInfo{ContentType: oidData},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+			Bytes: bytes.Join(cert.Certificate, nil)},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:            1,
+			IssuerAndSerial:    pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: leaf.RawIssuer}, Serial: leaf.SerialNumber},
+			DigestAlgorithm:    sha,
+			SignedAttrs:        asn1.RawValue{FullBytes: append([]byte{0xa0}, attrs[1:]...)},
+			SignatureAlgorithm: sigAlg,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// pkcs7Attributes encodes the attributes as a DER SET OF, from a list of
+// type, value pairs.
+func pkcs7Attributes(typeValue ...interface{}) ([]byte, error) {
+	attrs := make([]pkcs7Attribute, 0, len(typeValue)/2)
+	for i := 0; i+1 < len(typeValue); i += 2 {
+		v, err := asn1.Marshal(typeValue[i+1])
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, pkcs7Attribute{
+			Type:   typeValue[i].(asn1.ObjectIdentifier),
+			Values: []asn1.RawValue{{FullBytes: v}},
+		})
+	}
+	return asn1.MarshalWithParams(attrs, "set")
+}
@@ -0,0 +1,19 @@
+//go:build blackmail_no_smime
+// +build blackmail_no_smime
+
+package blackmail
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// SignSMIME is disabled with the blackmail_no_smime build tag; it always
+// returns an error.
+func SignSMIME(cert tls.Certificate) bodyPart {
+	return bodyPart{err: errors.New("blackmail.SignSMIME: compiled with blackmail_no_smime")}
+}
+
+func smimeSign(msg []byte, cert tls.Certificate, hashBoundary bool) ([]byte, error) {
+	return nil, errors.New("blackmail.SignSMIME: compiled with blackmail_no_smime")
+}
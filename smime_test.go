@@ -0,0 +1,216 @@
+//go:build !blackmail_no_smime
+// +build !blackmail_no_smime
+
+package blackmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/blackmail/internal/ztest"
+)
+
+func smimeTestCert(t *testing.T, key crypto.Signer) tls.Certificate {
+	t.Helper()
+	tpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: "me@example.com"},
+		EmailAddresses: []string{"me@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// smimeVerify verifies the detached PKCS #7 signature sig for content, and
+// returns the signer's certificate.
+func smimeVerify(content, sig []byte) (*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(sig, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("not SignedData")
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.New("not one signer")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	si := sd.SignerInfos[0]
+	var cert *x509.Certificate
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) && c.SerialNumber.Cmp(si.IssuerAndSerial.Serial) == 0 {
+			cert = c
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("no certificate for signer")
+	}
+
+	attrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	var parsed []pkcs7Attribute
+	if _, err := asn1.UnmarshalWithParams(attrs, &parsed, "set"); err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	var found bool
+	for _, a := range parsed {
+		if a.Type.Equal(oidMessageDigest) {
+			var d []byte
+			if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &d); err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(d, digest[:]) {
+				return nil, errors.New("wrong message digest")
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("no message digest")
+	}
+
+	alg := x509.SHA256WithRSA
+	if si.SignatureAlgorithm.Algorithm.Equal(oidECDSASHA256) {
+		alg = x509.ECDSAWithSHA256
+	}
+	return cert, cert.CheckSignature(alg, attrs, si.Signature)
+}
+
+func TestSignSMIME(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey} {
+		cert := smimeTestCert(t, key)
+		t.Run(name, func(t *testing.T) {
+			msg, _, err := Message("Signed", From("", "me@example.com"), To("to@example.com"),
+				Bodyf("Hello"), Attachment("", "x.csv", []byte("a,b\n")),
+				SignSMIME(cert))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := mail.ReadMessage(bytes.NewReader(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Header.Get("Subject") != "Signed" {
+				t.Errorf("Subject: %q", m.Header.Get("Subject"))
+			}
+			ct, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+				t.Fatalf("wrong Content-Type: %q", m.Header.Get("Content-Type"))
+			}
+
+			// The signed content is everything between the boundaries, without
+			// the CRLF before the next boundary.
+			parts := strings.Split(string(msg), "\r\n--"+params["boundary"])
+			if len(parts) != 4 || parts[3] != "--\r\n" {
+				t.Fatalf("wrong parts: %q", parts)
+			}
+			content := strings.TrimPrefix(parts[1], "\r\n")
+			if !strings.HasPrefix(content, "Content-Type: multipart/mixed;") {
+				t.Errorf("wrong signed content:\n%s", content)
+			}
+			sigHead, sig64, _ := strings.Cut(strings.TrimPrefix(parts[2], "\r\n"), "\r\n\r\n")
+			if !strings.Contains(sigHead, `Content-Type: application/pkcs7-signature; name="smime.p7s"`) {
+				t.Errorf("wrong signature headers:\n%s", sigHead)
+			}
+			sig, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(sig64, "\r\n", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := smimeVerify([]byte(content), sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.Raw, cert.Certificate[0]) {
+				t.Error("wrong certificate")
+			}
+
+			if _, err := smimeVerify([]byte(strings.Replace(content, "x.csv", "y.csv", 1)), sig); err == nil {
+				t.Error("modified content verified")
+			}
+		})
+	}
+
+	t.Run("DKIM", func(t *testing.T) {
+		_, pemKey := dkimTestKey(t)
+		msg, _, err := Message("Signed", From("", "me@example.com"), To("to@example.com"),
+			Bodyf("Hello"), SignSMIME(smimeTestCert(t, ecKey)),
+			DKIM(DKIMOptions{Domain: "example.com", Selector: "sel", PrivateKey: pemKey}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, tags := dkimTags(t, string(msg))
+		if !strings.Contains(tags["h"], "content-type") {
+			t.Errorf("Content-Type not signed: %q", tags["h"])
+		}
+		if !strings.Contains(string(msg), "\r\nContent-Type: multipart/signed;") {
+			t.Errorf("not signed with S/MIME:\n%s", msg)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			cert    tls.Certificate
+			wantErr string
+		}{
+			{tls.Certificate{}, "blackmail.SignSMIME: no certificate"},
+			{smimeTestCert(t, edKey), "only RSA and ECDSA keys are supported"},
+		}
+		for _, tt := range tests {
+			_, _, err := Message("Signed", From("", "me@example.com"), To("to@example.com"),
+				Bodyf("Hello"), SignSMIME(tt.cert))
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+		}
+	})
+}
@@ -6,10 +6,21 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
+// authDone is implemented by mechanisms that need to check if the exchange was
+// complete when the server accepts the authentication.
+type authDone interface {
+	done() error
+}
+
 // Common SASL errors.
 var (
 	ErrUnexpectedAuthResponse    = errors.New("sasl: unexpected client response")
@@ -91,3 +102,134 @@ func (a *cramMD5Auth) Next(challenge []byte) (response []byte, err error) {
 func CramMD5Auth(username, secret string) Auth {
 	return &cramMD5Auth{username, secret}
 }
+
+type scramAuth struct {
+	Username, Password string
+
+	nonce       string // Client nonce; generated in Start() if empty.
+	clientFirst string // client-first-message-bare
+	serverSig   []byte // Expected server signature.
+	step        int
+}
+
+func (a *scramAuth) Start() (mech string, ir []byte, err error) {
+	if a.nonce == "" {
+		b := make([]byte, 18)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		a.nonce = base64.RawStdEncoding.EncodeToString(b)
+	}
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.Username)
+	a.clientFirst = "n=" + user + ",r=" + a.nonce
+	a.step = 0
+	return "SCRAM-SHA-256", []byte("n,," + a.clientFirst), nil
+}
+
+func (a *scramAuth) Next(challenge []byte) (response []byte, err error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		attr := scramAttrs(string(challenge))
+		if e, ok := attr["e"]; ok {
+			return nil, fmt.Errorf("sasl: SCRAM-SHA-256: server error: %s", e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attr["v"])
+		if err != nil || len(sig) == 0 {
+			return nil, ErrUnexpectedServerChallenge
+		}
+		if !hmac.Equal(sig, a.serverSig) {
+			return nil, errors.New("sasl: SCRAM-SHA-256: invalid server signature")
+		}
+		return []byte{}, nil
+	default:
+		return nil, ErrUnexpectedServerChallenge
+	}
+}
+
+// done checks that the server sent its signature before accepting the
+// authentication; without it we don't know if the server knows the password.
+func (a *scramAuth) done() error {
+	if a.step < 2 {
+		return errors.New("sasl: SCRAM-SHA-256: server accepted authentication without sending its signature")
+	}
+	return nil
+}
+
+// clientFinal gets the client-final-message for the server-first-message.
+func (a *scramAuth) clientFinal(serverFirst string) ([]byte, error) {
+	attr := scramAttrs(serverFirst)
+	nonce := attr["r"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, ErrUnexpectedServerChallenge
+	}
+	salt, err := base64.StdEncoding.DecodeString(attr["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, ErrUnexpectedServerChallenge
+	}
+	iter, err := strconv.Atoi(attr["i"])
+	if err != nil || iter < 1 {
+		return nil, ErrUnexpectedServerChallenge
+	}
+
+	var (
+		salted    = pbkdf2SHA256([]byte(a.Password), salt, iter)
+		clientKey = hmacSHA256(salted, []byte("Client Key"))
+		storedKey = sha256.Sum256(clientKey)
+		final     = "c=biws,r=" + nonce // biws is base64 of the "n,," GS2 header.
+		authMsg   = []byte(a.clientFirst + "," + serverFirst + "," + final)
+		clientSig = hmacSHA256(storedKey[:], authMsg)
+		proof     = make([]byte, len(clientKey))
+		serverKey = hmacSHA256(salted, []byte("Server Key"))
+	)
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	a.serverSig = hmacSHA256(serverKey, authMsg)
+	return []byte(final + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// scramAttrs parses the "k=v,k=v" attributes in a SCRAM message.
+func scramAttrs(msg string) map[string]string {
+	attr := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) < 2 || kv[1] != '=' {
+			continue
+		}
+		attr[kv[:1]] = kv[2:]
+	}
+	return attr
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 is the Hi() function from RFC 5802; this is PBKDF2 with
+// HMAC-SHA-256 for a single block.
+func pbkdf2SHA256(password, salt []byte, iter int) []byte {
+	u := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	out := append([]byte{}, u...)
+	for i := 1; i < iter; i++ {
+		u = hmacSHA256(password, u)
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// ScramSHA256Auth implements the SCRAM-SHA-256 authentication mechanism, as
+// described in RFC 7677 and RFC 5802.
+//
+// Unlike PLAIN and LOGIN the password is never sent to the server, and the
+// server's signature is verified; it's an error if the server accepts the
+// authentication without sending it. Channel binding isn't supported, and the
+// password isn't normalized with SASLprep, so it should be ASCII.
+func ScramSHA256Auth(username, password string) Auth {
+	return &scramAuth{Username: username, Password: password}
+}
@@ -15,6 +15,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -24,6 +25,7 @@ import (
 	"net/textproto"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // MailOptions contains custom arguments that were passed as an argument to the
@@ -50,6 +52,59 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// What to include in a DSN (bounce message): the full message or just the
+	// headers. Empty means the server's default.
+	//
+	// Defined in RFC 3461.
+	Return DSNReturn
+
+	// Envelope identifier which is included in a DSN, so it can be correlated
+	// with the original message.
+	//
+	// Defined in RFC 3461.
+	EnvelopeID string
+}
+
+// DSNReturn is the RET parameter for MAIL.
+type DSNReturn string
+
+// Values for DSNReturn.
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// RcptOptions contains custom arguments for the RCPT command.
+type RcptOptions struct {
+	// When to send a DSN for this recipient. Empty means the server's
+	// default.
+	//
+	// Defined in RFC 3461.
+	Notify []DSNNotify
+
+	// Original recipient, in case the address was rewritten (e.g. by an
+	// alias). This is included in the DSN.
+	//
+	// Defined in RFC 3461.
+	OriginalRecipient string
+}
+
+// DSNNotify is the NOTIFY parameter for RCPT.
+type DSNNotify string
+
+// Values for DSNNotify; DSNNotifyNever can't be combined with other values.
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifyDelay   DSNNotify = "DELAY"
+)
+
+// RcptWithOptions is a recipient for Client.Rcpts().
+type RcptWithOptions struct {
+	Addr string
+	Opts *RcptOptions
 }
 
 type EnhancedCode [3]int
@@ -71,6 +126,26 @@ type Client struct {
 	// clients to add extensions.
 	Text *textproto.Conn
 
+	// CommandTimeout is the maximum time to wait for a command to be sent and
+	// the server to respond. The default of 0 means no timeout.
+	//
+	// The connection's deadline is cleared after every command if this is set.
+	CommandTimeout time.Duration
+
+	// SubmissionTimeout is the maximum time to wait for the server to respond
+	// after the message data is sent. Servers may take a while to scan the
+	// message, so this is usually longer than CommandTimeout. The default of 0
+	// means no timeout.
+	SubmissionTimeout time.Duration
+
+	// MaxLineLength is the maximum length of a line in the server's responses;
+	// ErrLineTooLong is returned for longer lines. The default of 0 uses
+	// DefaultMaxLineLength, and -1 means there is no limit.
+	//
+	// The greeting is read by NewClient(), so that always uses
+	// DefaultMaxLineLength.
+	MaxLineLength int
+
 	// keep a reference to the connection so it can be used to create a TLS
 	// connection later
 	conn net.Conn
@@ -141,33 +216,61 @@ func SendMail(addr string, a Auth, from string, to []string, r io.Reader) error
 			return err
 		}
 	}
-	if err = c.Mail(from, nil); err != nil {
+	if err = c.SendMail(from, to, r); err != nil {
 		return err
 	}
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+	return c.Quit()
+}
+
+// SendMail sends an email from address from, to addresses to, with message r
+// using the MAIL, RCPT, and DATA commands.
+//
+// Unlike the package-level SendMail() this uses the existing connection: it
+// doesn't dial, say hello, switch to TLS, or authenticate, and it doesn't send
+// QUIT, so the connection can be used for more messages after this.
+func (c *Client) SendMail(from string, to []string, r io.Reader) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
 			return err
 		}
 	}
-	w, err := c.Data()
-	if err != nil {
+
+	if err := c.Mail(from, nil); err != nil {
 		return err
 	}
-	_, err = io.Copy(w, r)
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
 	if err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
-	return c.Quit()
+	return w.Close()
 }
 
 // Dial returns a new Client connected to an SMTP server at addr. The addr must
 // include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return DialContext(context.Background(), addr, nil)
+}
+
+// DialContext is like Dial, but with a context and dialer. This allows setting
+// the local address, connection timeout, and other options of net.Dialer.
+//
+// A nil dialer is the same as a zero net.Dialer.
+func DialContext(ctx context.Context, addr string, d *net.Dialer) (*Client, error) {
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -189,17 +292,42 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string) (*Client, error) {
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
+	_, isTLS := conn.(*tls.Conn)
+	c := &Client{conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c.Text = c.newText(conn)
+	if err := c.greeting(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientText returns a new Client using an existing textproto.Conn and host
+// as a server name to be used when authenticating.
+//
+// This is useful if you want to wrap the connection at the protocol level, for
+// example to log or rate-limit commands. Because there is no net.Conn
+// StartTLS(), CommandTimeout, SubmissionTimeout, and MaxLineLength can't be
+// used; the text connection should handle all of that if needed.
+func NewClientText(text *textproto.Conn, host string) (*Client, error) {
+	c := &Client{Text: text, serverName: host, localName: "localhost"}
+	if err := c.greeting(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientLMTP returns a new LMTP client (RFC 2033) using an existing
+// connection and host as a server name to be used when authenticating.
+//
+// This works like an SMTP client, except that LHLO is sent instead of EHLO, and
+// the server replies to DATA for every recipient; use LMTPData() to get these
+// replies.
+func NewClientLMTP(conn net.Conn, host string) (*Client, error) {
+	c, err := NewClient(conn, host)
 	if err != nil {
-		text.Close()
-		if protoErr, ok := err.(*textproto.Error); ok {
-			return nil, toSMTPErr(protoErr)
-		}
 		return nil, err
 	}
-	_, isTLS := conn.(*tls.Conn)
-	c := &Client{Text: text, conn: conn, serverName: host, localName: "localhost", tls: isTLS}
+	c.lmtp = true
 	return c, nil
 }
 
@@ -214,13 +342,17 @@ func (c *Client) hello() error {
 		c.didHello = true
 		err := c.ehlo()
 		if err != nil {
-			c.helloError = c.helo()
+			if c.lmtp { // There is no fallback for LHLO.
+				c.helloError = err
+			} else {
+				c.helloError = c.helo()
+			}
 		}
 	}
 	return c.helloError
 }
 
-// Hello sends a HELO or EHLO to the server as the given host name.
+// Hello sends a HELO, EHLO, or LHLO to the server as the given host name.
 // Calling this method is only necessary if the client needs control
 // over the host name used. The client will introduce itself as "localhost"
 // automatically otherwise. If Hello is called, it must be called before
@@ -257,12 +389,32 @@ func (c *Client) ehlo() error {
 	if err != nil {
 		return err
 	}
-	ext := make(map[string]string)
-	extList := strings.Split(msg, "\n")
+	var (
+		ext     = make(map[string]string)
+		extList = strings.Split(msg, "\n")
+		auth    []string
+	)
 	if len(extList) > 1 {
 		extList = extList[1:]
 		for _, line := range extList {
 			args := strings.SplitN(line, " ", 2)
+			k, v, _ := strings.Cut(args[0], "=")
+
+			// Old servers such as Exchange advertise "AUTH=LOGIN PLAIN" instead
+			// of, or as well as, "AUTH LOGIN PLAIN".
+			if strings.EqualFold(k, "AUTH") {
+				if len(args) > 1 {
+					v += " " + args[1]
+				}
+				for _, m := range strings.Fields(v) {
+					if !contains(auth, m) {
+						auth = append(auth, m)
+					}
+				}
+				ext["AUTH"] = strings.Join(auth, " ")
+				continue
+			}
+
 			if len(args) > 1 {
 				ext[args[0]] = args[1]
 			} else {
@@ -270,9 +422,7 @@ func (c *Client) ehlo() error {
 			}
 		}
 	}
-	if mechs, ok := ext["AUTH"]; ok {
-		c.auth = strings.Split(mechs, " ")
-	}
+	c.auth = auth
 	c.ext = ext
 	return err
 }
@@ -282,6 +432,9 @@ func (c *Client) ehlo() error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) StartTLS(config *tls.Config) error {
+	if c.conn == nil {
+		return errors.New("smtp: StartTLS not supported on clients created with NewClientText")
+	}
 	if err := c.hello(); err != nil {
 		return err
 	}
@@ -301,7 +454,7 @@ func (c *Client) StartTLS(config *tls.Config) error {
 		testHookStartTLS(config)
 	}
 	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	c.Text = c.newText(c.conn)
 	c.tls = true
 	return c.ehlo()
 }
@@ -354,10 +507,17 @@ func (c *Client) Auth(a Auth) error {
 		var msg []byte
 		switch code {
 		case 334:
+			// Multi-line challenges are joined with "\n" by textproto; the
+			// base64 decoder ignores newlines.
 			msg, err = encoding.DecodeString(msg64)
 		case 235:
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
+			if d, ok := a.(authDone); ok {
+				if err := d.done(); err != nil {
+					return err
+				}
+			}
 		default:
 			err = toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
 		}
@@ -404,6 +564,9 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		cmdStr += " BODY=8BITMIME"
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
+		if max, ok := c.MaxMessageSize(); ok && max > 0 && opts.Size > max {
+			return fmt.Errorf("smtp: message size of %d bytes exceeds the server's maximum of %d", opts.Size, max)
+		}
 		cmdStr += " SIZE=" + strconv.Itoa(opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
@@ -422,10 +585,20 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 	}
 	if opts != nil && opts.Auth != nil {
 		if _, ok := c.ext["AUTH"]; ok {
-			cmdStr += " AUTH=" + encodeXtext(*opts.Auth)
+			cmdStr += " AUTH=" + strings.ReplaceAll(encodeXtext(*opts.Auth), "%", "%%")
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
+	if _, ok := c.ext["DSN"]; ok && opts != nil {
+		// DSN parameters are only a request, so discard them if the server
+		// does not support it.
+		if opts.Return != "" {
+			cmdStr += " RET=" + string(opts.Return)
+		}
+		if opts.EnvelopeID != "" {
+			cmdStr += " ENVID=" + strings.ReplaceAll(encodeXtext(opts.EnvelopeID), "%", "%%")
+		}
+	}
 	_, _, err := c.cmd(250, cmdStr, from)
 	return err
 }
@@ -446,18 +619,176 @@ func (c *Client) Rcpt(to string) error {
 	return nil
 }
 
+// Rcpts issues a RCPT command for every address, pipelining the commands if
+// the server supports the PIPELINING extension.
+//
+// Unlike Rcpt, a rejected recipient doesn't abort: the returned map contains
+// every address, with a nil value if the server accepted it, or the *SMTPError
+// if it rejected it. The error is only set for problems other than rejected
+// recipients, such as an invalid address or a network error; the transaction
+// should be aborted in that case.
+//
+// Options are only added if the server supports the DSN extension.
+func (c *Client) Rcpts(rcpts []RcptWithOptions) (map[string]*SMTPError, error) {
+	cmds := make([]string, 0, len(rcpts))
+	for _, r := range rcpts {
+		if err := validateLine(r.Addr); err != nil {
+			return nil, err
+		}
+		cmd, err := c.rcptCmd(r.Addr, r.Opts)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	defer c.deadline(c.CommandTimeout)()
+	res := make(map[string]*SMTPError, len(rcpts))
+	read := func(i int, id uint) error {
+		c.Text.StartResponse(id)
+		defer c.Text.EndResponse(id)
+		_, _, err := c.Text.ReadResponse(25)
+		if err != nil {
+			protoErr, ok := err.(*textproto.Error)
+			if !ok {
+				return err
+			}
+			res[rcpts[i].Addr] = toSMTPErr(protoErr)
+			return nil
+		}
+		res[rcpts[i].Addr] = nil
+		c.rcpts = append(c.rcpts, rcpts[i].Addr)
+		return nil
+	}
+
+	if _, ok := c.ext["PIPELINING"]; ok {
+		ids := make([]uint, 0, len(cmds))
+		for _, cmd := range cmds {
+			id, err := c.Text.Cmd("%s", cmd)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		for i, id := range ids {
+			if err := read(i, id); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	for i, cmd := range cmds {
+		id, err := c.Text.Cmd("%s", cmd)
+		if err != nil {
+			return nil, err
+		}
+		if err := read(i, id); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (c *Client) rcptCmd(to string, opts *RcptOptions) (string, error) {
+	cmd := "RCPT TO:<" + to + ">"
+	if _, ok := c.ext["DSN"]; !ok || opts == nil {
+		return cmd, nil
+	}
+
+	if len(opts.Notify) > 0 {
+		n := make([]string, 0, len(opts.Notify))
+		for _, v := range opts.Notify {
+			if v == DSNNotifyNever && len(opts.Notify) > 1 {
+				return "", errors.New("smtp: NEVER can't be combined with other NOTIFY values")
+			}
+			n = append(n, string(v))
+		}
+		cmd += " NOTIFY=" + strings.Join(n, ",")
+	}
+	if opts.OriginalRecipient != "" {
+		if err := validateLine(opts.OriginalRecipient); err != nil {
+			return "", err
+		}
+		cmd += " ORCPT=rfc822;" + encodeXtext(opts.OriginalRecipient)
+	}
+	return cmd, nil
+}
+
+// DataResponse is the response returned by the server after the DATA command
+// finishes.
+type DataResponse struct {
+	// StatusText is the text returned by the server, without the status code.
+	StatusText string
+
+	// QueueID and Size are parsed from StatusText if the server includes them,
+	// for example "2.0.0 Ok: queued as 3F2A" or "OK id=1rX2-0003 size=1234".
+	// This is on a best-effort basis, and they will be empty if the server
+	// doesn't include them in a format we recognize.
+	QueueID string
+	Size    int
+}
+
+// DataCommand is a writer for the message body sent with DATA; get one with
+// Client.Data().
+type DataCommand struct {
+	c *Client
+	io.WriteCloser
+	statusCb func(rcpt string, status *SMTPError)
+}
+
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the mail headers and body. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
 //
+// The writer dot-stuffs lines starting with "." and adds the terminating
+// "\r\n.\r\n" on Close, so the message should be written as-is without any
+// escaping.
+//
 // If server returns an error, it will be of type *SMTPError.
-func (c *Client) Data() (io.WriteCloser, error) {
+func (c *Client) Data() (*DataCommand, error) {
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter(), nil}, nil
+	return &DataCommand{c, c.Text.DotWriter(), nil}, nil
+}
+
+// DataBDAT is like Data(), but sends the message with BDAT commands (RFC 3030)
+// if the server supports the CHUNKING extension, falling back to Data() if it
+// doesn't.
+//
+// The message is sent in chunks of size bytes (64K if it's 0 or lower) as it's
+// written, followed by "BDAT 0 LAST" when the writer is closed. Unlike DATA, the
+// message isn't dot-stuffed, so it's sent as-is and must have CRLF line endings.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) DataBDAT(size int) (*DataCommand, error) {
+	if ok, _ := c.Extension("CHUNKING"); !ok {
+		return c.Data()
+	}
+	if size <= 0 {
+		size = 64 * 1024
+	}
+	return &DataCommand{c, &bdatWriter{c: c, size: size}, nil}, nil
+}
+
+// LMTPData is like Data(), but for LMTP clients created with NewClientLMTP().
+//
+// After the writer is closed the server replies for every recipient that was
+// accepted with Rcpt; statusCb is called for every recipient with the error, or
+// nil if the message was delivered to them.
+func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (*DataCommand, error) {
+	if !c.lmtp {
+		return nil, errors.New("smtp: LMTPData called on an SMTP client")
+	}
+	d, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	d.statusCb = statusCb
+	return d, nil
 }
 
 // Extension reports whether an extension is support by the server.
@@ -477,6 +808,20 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
+// MaxMessageSize returns the maximum message size the server accepts, as
+// advertised with the SIZE extension (RFC 1870).
+//
+// It returns false if the server doesn't advertise SIZE, and 0 if the server
+// doesn't have a fixed limit.
+func (c *Client) MaxMessageSize() (int, bool) {
+	ok, param := c.Extension("SIZE")
+	if !ok {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(param)
+	return n, true
+}
+
 // Reset sends the RSET command to the server, aborting the current mail
 // transaction.
 func (c *Client) Reset() error {
@@ -518,6 +863,7 @@ func (c *Client) Quit() error {
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.Text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	defer c.deadline(c.CommandTimeout)()
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
 		return 0, "", err
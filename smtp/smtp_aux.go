@@ -1,25 +1,99 @@
 package smtp
 
 import (
+	"bufio"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/textproto"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
-type dataCloser struct {
-	c *Client
-	io.WriteCloser
-	statusCb func(rcpt string, status *SMTPError)
+// DefaultMaxLineLength is the default for Client.MaxLineLength.
+//
+// RFC 5321 limits reply lines to 512 bytes, but some servers send much longer
+// lines, for example for a long list of AUTH mechanisms in the EHLO response.
+const DefaultMaxLineLength = 64 * 1024
+
+// ErrLineTooLong is returned if the server sends a line longer than
+// Client.MaxLineLength.
+var ErrLineTooLong = errors.New("smtp: response line too long")
+
+func (c *Client) newText(conn net.Conn) *textproto.Conn {
+	t := textproto.NewConn(conn)
+	t.Reader = *textproto.NewReader(bufio.NewReader(&lineLimiter{r: conn, c: c}))
+	return t
+}
+
+// greeting reads the 220 greeting from the server, closing the connection on
+// errors.
+func (c *Client) greeting() error {
+	_, _, err := c.Text.ReadResponse(220)
+	if err != nil {
+		c.Text.Close()
+		if protoErr, ok := err.(*textproto.Error); ok {
+			return toSMTPErr(protoErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// lineLimiter returns ErrLineTooLong if a line is longer than the client's
+// MaxLineLength. The connection can't be used after this, so all further reads
+// return the same error.
+type lineLimiter struct {
+	r   io.Reader
+	c   *Client
+	n   int // Length of the current line.
+	err error
+}
+
+func (l *lineLimiter) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(p)
+	max := l.c.MaxLineLength
+	if max == 0 {
+		max = DefaultMaxLineLength
+	}
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			l.n = 0
+			continue
+		}
+		l.n++
+		if max > 0 && l.n > max {
+			l.err = ErrLineTooLong
+			return i, l.err
+		}
+	}
+	return n, err
+}
+
+// Close the writer and read the response from the server.
+func (d *DataCommand) Close() error {
+	_, err := d.CloseWithResponse()
+	return err
 }
 
-func (d *dataCloser) Close() error {
-	d.WriteCloser.Close()
+// CloseWithResponse is like Close(), but also returns the response from the
+// server.
+//
+// This is not supported for LMTP, where there is a response for every
+// recipient; it will always return a nil DataResponse.
+func (d *DataCommand) CloseWithResponse() (*DataResponse, error) {
+	defer d.c.deadline(d.c.SubmissionTimeout)()
+	if err := d.WriteCloser.Close(); err != nil {
+		return nil, err
+	}
 	expectedResponses := len(d.c.rcpts)
 	if d.c.lmtp {
 		for expectedResponses > 0 {
@@ -30,24 +104,126 @@ func (d *dataCloser) Close() error {
 						d.statusCb(rcpt, toSMTPErr(protoErr))
 					}
 				} else {
-					return err
+					return nil, err
 				}
 			} else if d.statusCb != nil {
 				d.statusCb(rcpt, nil)
 			}
 			expectedResponses--
 		}
-		return nil
+		return nil, nil
+	}
+
+	_, msg, err := d.c.Text.ReadResponse(250)
+	if err != nil {
+		if protoErr, ok := err.(*textproto.Error); ok {
+			return nil, toSMTPErr(protoErr)
+		}
+		return nil, err
+	}
+	return parseDataResponse(msg), nil
+}
+
+// bdatWriter sends everything written to it in BDAT chunks.
+type bdatWriter struct {
+	c    *Client
+	size int
+	buf  []byte
+	err  error
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= w.size {
+		if w.err = w.chunk(w.buf[:w.size], false); w.err != nil {
+			return 0, w.err
+		}
+		w.buf = w.buf[:copy(w.buf, w.buf[w.size:])]
+	}
+	return len(p), nil
+}
+
+// Close sends the remaining data and "BDAT 0 LAST"; the response to that is
+// read by DataCommand.CloseWithResponse().
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		if w.err = w.chunk(w.buf, false); w.err != nil {
+			return w.err
+		}
+		w.buf = w.buf[:0]
+	}
+	w.err = w.chunk(nil, true)
+	return w.err
+}
+
+// chunk sends a BDAT command, and reads the response unless it's the last one.
+func (w *bdatWriter) chunk(b []byte, last bool) error {
+	defer w.c.deadline(w.c.CommandTimeout)()
+
+	t := w.c.Text
+	id := t.Next()
+	t.StartRequest(id)
+	if last {
+		fmt.Fprintf(t.W, "BDAT %d LAST\r\n", len(b))
 	} else {
-		_, _, err := d.c.Text.ReadResponse(250)
-		if err != nil {
-			if protoErr, ok := err.(*textproto.Error); ok {
-				return toSMTPErr(protoErr)
-			}
-			return err
+		fmt.Fprintf(t.W, "BDAT %d\r\n", len(b))
+	}
+	t.W.Write(b)
+	err := t.W.Flush()
+	t.EndRequest(id)
+
+	t.StartResponse(id)
+	defer t.EndResponse(id)
+	if err != nil || last {
+		return err
+	}
+	_, _, err = t.ReadResponse(250)
+	if protoErr, ok := err.(*textproto.Error); ok {
+		return toSMTPErr(protoErr)
+	}
+	return err
+}
+
+// deadline sets the connection's deadline to d from now, returning a function
+// to clear it again. It does nothing if d is 0.
+func (c *Client) deadline(d time.Duration) func() {
+	if d <= 0 || c.conn == nil {
+		return func() {}
+	}
+	c.conn.SetDeadline(time.Now().Add(d))
+	return func() { c.conn.SetDeadline(time.Time{}) }
+}
+
+// parseDataResponse parses the queue ID and size from the DATA response text.
+//
+//   250 2.0.0 Ok: queued as 3F2A1C0B12                       Postfix
+//   250 OK id=1rX2Ab-0003Xy-1Q                               Exim
+//   250 2.0.0 4AGCBvhP012345 Message accepted for delivery   Sendmail
+//   250 2.0.0 Ok: queued as <x> size=1234
+func parseDataResponse(msg string) *DataResponse {
+	r := &DataResponse{StatusText: msg}
+
+	f := strings.Fields(msg)
+	for i := range f {
+		switch {
+		case strings.HasPrefix(f[i], "id=") && r.QueueID == "":
+			r.QueueID = strings.Trim(f[i][3:], "<>,;")
+		case strings.HasPrefix(f[i], "size="):
+			r.Size, _ = strconv.Atoi(strings.Trim(f[i][5:], ",;"))
+		case f[i] == "queued" && i+2 < len(f) && f[i+1] == "as" && r.QueueID == "":
+			r.QueueID = strings.Trim(f[i+2], "<>,;")
+		case i+2 < len(f) && f[i+1] == "Message" && f[i+2] == "accepted" && r.QueueID == "":
+			// Sendmail: "2.0.0 4AGCBvhP012345 Message accepted for delivery"
+			r.QueueID = f[i]
 		}
-		return nil
 	}
+	return r
 }
 
 func parseEnhancedCode(s string) (EnhancedCode, error) {
@@ -101,21 +277,29 @@ func validateLine(line string) error {
 	return nil
 }
 
+// encodeXtext encodes raw as xtext (RFC 3461 4): printable ASCII except "+"
+// and "=" is kept as-is, everything else is encoded as "+XX". Non-ASCII is
+// encoded per byte.
 func encodeXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
-	for _, ch := range raw {
-		if ch == '+' || ch == '=' {
-			out.WriteRune('+')
-			out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch >= '!' && ch <= '~' && ch != '+' && ch != '=' {
+			out.WriteByte(ch)
+			continue
 		}
-		if ch > '!' && ch < '~' { // printable non-space US-ASCII
-			out.WriteRune(ch)
-		}
-		// Non-ASCII.
-		out.WriteRune('+')
-		out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+		fmt.Fprintf(&out, "+%02X", ch)
 	}
 	return out.String()
 }
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
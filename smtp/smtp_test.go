@@ -7,15 +7,23 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"net/textproto"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"zgo.at/blackmail/internal/ztest"
 )
 
 // Issue 17794: don't send a trailing space on AUTH command when there's no password.
@@ -58,6 +66,52 @@ func (toServerEmptyAuth) Next(fromServer []byte) (toServer []byte, err error) {
 	panic("unexpected call")
 }
 
+func TestClientAuthMultiline(t *testing.T) {
+	challenge := bytes.Repeat([]byte("a long GSSAPI token\x00\xff"), 20)
+	c64 := base64.StdEncoding.EncodeToString(challenge)
+	server := "220 hello world\r\n" +
+		"334-" + c64[:100] + "\r\n" +
+		"334-" + c64[100:200] + "\r\n" +
+		"334 " + c64[200:] + "\r\n" +
+		"235 Accepted\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(server), &wrote}
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.didHello = true
+
+	a := &recordAuth{resp: []byte("response")}
+	if err := c.Auth(a); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.got) != 1 || !bytes.Equal(a.got[0], challenge) {
+		t.Errorf("wrong challenge:\ngot:  %q\nwant: %q", a.got, challenge)
+	}
+	if got, want := wrote.String(), "AUTH X-TEST\r\ncmVzcG9uc2U=\r\n"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+// recordAuth records the challenges from the server, and responds with resp to
+// the first one.
+type recordAuth struct {
+	resp []byte
+	got  [][]byte
+}
+
+func (a *recordAuth) Start() (string, []byte, error) { return "X-TEST", nil, nil }
+func (a *recordAuth) Next(fromServer []byte) ([]byte, error) {
+	a.got = append(a.got, fromServer)
+	return a.resp, nil
+}
+
 type faker struct {
 	io.ReadWriter
 }
@@ -70,8 +124,8 @@ func (f faker) SetReadDeadline(time.Time) error  { return nil }
 func (f faker) SetWriteDeadline(time.Time) error { return nil }
 
 func TestBasic(t *testing.T) {
-	server := strings.Join(strings.Split(basicServer, "\n"), "\r\n")
-	client := strings.Join(strings.Split(basicClient, "\n"), "\r\n")
+	server := ztest.CRLF(basicServer)
+	client := ztest.CRLF(basicClient)
 
 	var cmdbuf bytes.Buffer
 	bcmdbuf := bufio.NewWriter(&cmdbuf)
@@ -169,7 +223,7 @@ func TestBasic_SMTPError(t *testing.T) {
 	// this means it can be violated hence we need to handle last
 	// case properly.
 
-	faultyServer = strings.Join(strings.Split(faultyServer, "\n"), "\r\n")
+	faultyServer = ztest.CRLF(faultyServer)
 
 	var wrote bytes.Buffer
 	var fake faker
@@ -258,8 +312,8 @@ QUIT
 `
 
 func TestNewClient(t *testing.T) {
-	server := strings.Join(strings.Split(newClientServer, "\n"), "\r\n")
-	client := strings.Join(strings.Split(newClientClient, "\n"), "\r\n")
+	server := ztest.CRLF(newClientServer)
+	client := ztest.CRLF(newClientClient)
 
 	var cmdbuf bytes.Buffer
 	bcmdbuf := bufio.NewWriter(&cmdbuf)
@@ -302,9 +356,74 @@ var newClientClient = `EHLO localhost
 QUIT
 `
 
+func TestNewClientText(t *testing.T) {
+	conn, server := net.Pipe()
+	t.Cleanup(func() { conn.Close(); server.Close() })
+	go func() {
+		tc := textproto.NewConn(server)
+		tc.PrintfLine("220 hello world")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO "):
+				tc.PrintfLine("250 localhost")
+			case line == "DATA":
+				tc.PrintfLine("354 Go ahead")
+				if _, err := tc.ReadDotBytes(); err != nil {
+					return
+				}
+				tc.PrintfLine("250 Queued")
+			case line == "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("250 Ok")
+			}
+		}
+	}()
+
+	var cmds bytes.Buffer
+	text := textproto.NewConn(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{conn, io.MultiWriter(conn, &cmds), conn})
+
+	c, err := NewClientText(text, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("from@example.com", []string{"to@example.com"}, strings.NewReader("Subject: x\r\n\r\nHello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartTLS(nil); !ztest.ErrorContains(err, "NewClientText") {
+		t.Errorf("wrong error for StartTLS: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ztest.CRLF(`EHLO localhost
+MAIL FROM:<from@example.com>
+RCPT TO:<to@example.com>
+DATA
+Subject: x
+
+Hello
+.
+QUIT
+`)
+	if cmds.String() != want {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", cmds.String(), want)
+	}
+}
+
 func TestNewClient2(t *testing.T) {
-	server := strings.Join(strings.Split(newClient2Server, "\n"), "\r\n")
-	client := strings.Join(strings.Split(newClient2Client, "\n"), "\r\n")
+	server := ztest.CRLF(newClient2Server)
+	client := ztest.CRLF(newClient2Client)
 
 	var cmdbuf bytes.Buffer
 	bcmdbuf := bufio.NewWriter(&cmdbuf)
@@ -350,8 +469,8 @@ func TestHello(t *testing.T) {
 	}
 
 	for i := 0; i < len(helloServer); i++ {
-		server := strings.Join(strings.Split(baseHelloServer+helloServer[i], "\n"), "\r\n")
-		client := strings.Join(strings.Split(baseHelloClient+helloClient[i], "\n"), "\r\n")
+		server := ztest.CRLF(baseHelloServer + helloServer[i])
+		client := ztest.CRLF(baseHelloClient + helloClient[i])
 		var cmdbuf bytes.Buffer
 		bcmdbuf := bufio.NewWriter(&cmdbuf)
 		var fake faker
@@ -456,8 +575,8 @@ var helloClient = []string{
 }
 
 func TestSendMail(t *testing.T) {
-	server := strings.Join(strings.Split(sendMailServer, "\n"), "\r\n")
-	client := strings.Join(strings.Split(sendMailClient, "\n"), "\r\n")
+	server := ztest.CRLF(sendMailServer)
+	client := ztest.CRLF(sendMailClient)
 	var cmdbuf bytes.Buffer
 	bcmdbuf := bufio.NewWriter(&cmdbuf)
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -533,6 +652,80 @@ SendMail is working for me.
 	}
 }
 
+func TestClientSendMail(t *testing.T) {
+	server := ztest.CRLF(clientSendMailServer)
+	client := ztest.CRLF(clientSendMailClient)
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Auth(PlainAuth("", "user", "pass")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send two messages on the same connection.
+	for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+		err := c.SendMail("test@example.com", []string{rcpt}, strings.NewReader("Subject: Test\r\n\r\n.Hello\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = c.SendMail("test@example.com", []string{"other@example.com>\r\nDATA"}, strings.NewReader(""))
+	if err == nil {
+		t.Error("no error for message injection attempt")
+	}
+
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	bcmdbuf.Flush()
+	if got := cmdbuf.String(); got != client {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, client)
+	}
+}
+
+var clientSendMailServer = `220 hello world
+250-mx.example.com at your service
+250 AUTH PLAIN
+235 Accepted
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+221 Goodbye
+`
+
+var clientSendMailClient = `EHLO localhost
+AUTH PLAIN AHVzZXIAcGFzcw==
+MAIL FROM:<test@example.com>
+RCPT TO:<a@example.com>
+DATA
+Subject: Test
+
+..Hello
+.
+MAIL FROM:<test@example.com>
+RCPT TO:<b@example.com>
+DATA
+Subject: Test
+
+..Hello
+.
+QUIT
+`
+
 var sendMailServer = `220 hello world
 502 EH?
 250 mx.google.com at your service
@@ -605,8 +798,8 @@ SendMail is working for me.
 }
 
 func TestAuthFailed(t *testing.T) {
-	server := strings.Join(strings.Split(authFailedServer, "\n"), "\r\n")
-	client := strings.Join(strings.Split(authFailedClient, "\n"), "\r\n")
+	server := ztest.CRLF(authFailedServer)
+	client := ztest.CRLF(authFailedClient)
 	var cmdbuf bytes.Buffer
 	bcmdbuf := bufio.NewWriter(&cmdbuf)
 	var fake faker
@@ -837,19 +1030,82 @@ jiC0k/9L5dHUsF0XZothAkEA23ddgRs+Id/HxtojqqUT27B8MT/IGNrYsp4DvS/c
 qgkeluku4GjxRlDMBuXk94xOBEinUs+p/hwP1Alll80Tpg==
 -----END RSA PRIVATE KEY-----`)
 
-var lmtpServer = `250-localhost at your service
+func TestLMTP(t *testing.T) {
+	server := ztest.CRLF(lmtpServer)
+	client := ztest.CRLF(lmtpClient)
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := NewClientLMTP(fake, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("golang-dev@googlegroups.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	status := make(map[string]*SMTPError)
+	w, err := c.LMTPData(func(rcpt string, s *SMTPError) { status[rcpt] = s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(w, strings.ReplaceAll(`From: user@gmail.com
+To: golang-nuts@googlegroups.com
+Subject: Hooray for Go
+
+Line 1
+.Leading dot line .
+Goodbye.`, "\n", "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := status["golang-nuts@googlegroups.com"]; !ok || s != nil {
+		t.Errorf("wrong status for golang-nuts: %v", s)
+	}
+	if s := status["golang-dev@googlegroups.com"]; s == nil || s.Code != 452 {
+		t.Errorf("wrong status for golang-dev: %v", s)
+	}
+
+	bcmdbuf.Flush()
+	if got := cmdbuf.String(); got != client {
+		t.Errorf("\ngot:\n%s\nwant:\n%s", got, client)
+	}
+}
+
+var lmtpServer = `220 hello world
+250-localhost at your service
 250-SIZE 35651584
 250 8BITMIME
 250 Sender OK
 250 Receiver OK
+250 Receiver OK
 354 Go ahead
 250 Data OK
+452 4.2.2 Mailbox full
 221 OK
 `
 
 var lmtpClient = `LHLO localhost
 MAIL FROM:<user@gmail.com> BODY=8BITMIME
 RCPT TO:<golang-nuts@googlegroups.com>
+RCPT TO:<golang-dev@googlegroups.com>
 DATA
 From: user@gmail.com
 To: golang-nuts@googlegroups.com
@@ -861,3 +1117,655 @@ Goodbye.
 .
 QUIT
 `
+
+func TestMaxLineLength(t *testing.T) {
+	long := "250 X-LONG" + strings.Repeat(" param", 12_000) + "\n" // ~70K
+
+	tests := []struct {
+		name    string
+		max     int
+		wantErr error
+	}{
+		{"default", 0, ErrLineTooLong},
+		{"larger", 100_000, nil},
+		{"no limit", -1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" + long)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.MaxLineLength = tt.max
+
+			err = c.Hello("localhost")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if tt.wantErr == nil && len(c.ext["X-LONG"]) != 12_000*6-1 {
+				t.Errorf("wrong length for X-LONG: %d", len(c.ext["X-LONG"]))
+			}
+		})
+	}
+}
+
+func TestDataBDAT(t *testing.T) {
+	body := "Line 1\r\n.Leading dot\r\n" // 22 bytes
+
+	tests := []struct {
+		ext          string
+		server, want string
+	}{
+		{"250-CHUNKING\n", "250 chunk\n250 chunk\n250 chunk\n250 Data OK\n",
+			"BDAT 10\r\nLine 1\r\n.L" + "BDAT 10\r\neading dot" + "BDAT 2\r\n\r\n" + "BDAT 0 LAST\r\n"},
+		{"", "354 Go ahead\n250 Data OK\n",
+			"DATA\r\nLine 1\r\n..Leading dot\r\n.\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				tt.ext + "250 8BITMIME\n250 Sender OK\n250 Receiver OK\n" + tt.server + "221 OK\n")
+			var cmdbuf bytes.Buffer
+			bcmdbuf := bufio.NewWriter(&cmdbuf)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if err := c.Mail("user@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Rcpt("rcpt@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			w, err := c.DataBDAT(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Write in two parts to make sure it's buffered correctly.
+			if _, err := io.WriteString(w, body[:7]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, body[7:]); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := w.CloseWithResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusText != "Data OK" {
+				t.Errorf("wrong response: %v", resp)
+			}
+			if err := c.Quit(); err != nil {
+				t.Fatal(err)
+			}
+
+			bcmdbuf.Flush()
+			want := ztest.CRLF("EHLO localhost\nMAIL FROM:<user@example.com> BODY=8BITMIME\n" +
+				"RCPT TO:<rcpt@example.com>\n") + tt.want + "QUIT\r\n"
+			if got := cmdbuf.String(); got != want {
+				t.Errorf("\ngot:\n%q\nwant:\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestDataResponse(t *testing.T) {
+	server := ztest.CRLF(`220 hello world
+250 mx.example.com at your service
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 2.0.0 OK id=1rX2Ab-0003Xy-1Q size=25
+`)
+
+	var cmdbuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(&cmdbuf))
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("from@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("to@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: test\r\n\r\nhowdy!\r\n"))
+	resp, err := w.CloseWithResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DataResponse{StatusText: "2.0.0 OK id=1rX2Ab-0003Xy-1Q size=25", QueueID: "1rX2Ab-0003Xy-1Q", Size: 25}
+	if *resp != want {
+		t.Errorf("\ngot:  %#v\nwant: %#v", *resp, want)
+	}
+}
+
+func TestParseDataResponse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want DataResponse
+	}{
+		{"Ok", DataResponse{}},
+		{"2.0.0 Ok: queued as 3F2A1C0B12", DataResponse{QueueID: "3F2A1C0B12"}},
+		{"OK id=1rX2Ab-0003Xy-1Q", DataResponse{QueueID: "1rX2Ab-0003Xy-1Q"}},
+		{"2.0.0 Ok: queued as <abc> size=1234", DataResponse{QueueID: "abc", Size: 1234}},
+		{"2.0.0 Ok: queued as", DataResponse{}},
+		{"2.0.0 4AGCBvhP012345 Message accepted for delivery", DataResponse{QueueID: "4AGCBvhP012345"}},
+		{"Message accepted for delivery", DataResponse{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			tt.want.StatusText = tt.in
+			got := parseDataResponse(tt.in)
+			if *got != tt.want {
+				t.Errorf("\ngot:  %#v\nwant: %#v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		ext, want, wantErr string
+	}{
+		{"250 SMTPUTF8", "EHLO localhost\r\nMAIL FROM:<fröm@example.com> SMTPUTF8\r\n", ""},
+		{"250 8BITMIME", "EHLO localhost\r\n", "server does not support SMTPUTF8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				tt.ext + "\n250 Sender ok\n")
+
+			var cmdbuf bytes.Buffer
+			bcmdbuf := bufio.NewWriter(&cmdbuf)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Mail("fröm@example.com", &MailOptions{UTF8: true})
+			if (err == nil && tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			bcmdbuf.Flush()
+			if got := cmdbuf.String(); got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientDSN(t *testing.T) {
+	tests := []struct {
+		ext  string
+		opts MailOptions
+		want string
+	}{
+		{"250 DSN", MailOptions{Return: DSNReturnHeaders, EnvelopeID: "id+1=2 %x"},
+			"MAIL FROM:<from@example.com> RET=HDRS ENVID=id+2B1+3D2+20%x\r\n"},
+		{"250 DSN", MailOptions{Return: DSNReturnFull}, "MAIL FROM:<from@example.com> RET=FULL\r\n"},
+		{"250 8BITMIME", MailOptions{Return: DSNReturnHeaders, EnvelopeID: "id"},
+			"MAIL FROM:<from@example.com> BODY=8BITMIME\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				tt.ext + "\n250 Sender ok\n")
+
+			var cmdbuf bytes.Buffer
+			bcmdbuf := bufio.NewWriter(&cmdbuf)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Mail("from@example.com", &tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			bcmdbuf.Flush()
+			if got := cmdbuf.String(); got != "EHLO localhost\r\n"+tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeXtext(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"abc!~", "abc!~"},
+		{"a+b=c d", "a+2Bb+3Dc+20d"},
+		{"é", "+C3+A9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := encodeXtext(tt.in); got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientRequireTLS(t *testing.T) {
+	tests := []struct {
+		ext, want, wantErr string
+	}{
+		{"250 REQUIRETLS", "EHLO localhost\r\nMAIL FROM:<from@example.com> REQUIRETLS\r\n", ""},
+		{"250 8BITMIME", "EHLO localhost\r\n", "server does not support REQUIRETLS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				tt.ext + "\n250 Sender ok\n")
+
+			var cmdbuf bytes.Buffer
+			bcmdbuf := bufio.NewWriter(&cmdbuf)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Mail("from@example.com", &MailOptions{RequireTLS: true})
+			if (err == nil && tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			bcmdbuf.Flush()
+			if got := cmdbuf.String(); got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientRcpts(t *testing.T) {
+	for _, ext := range []string{"250-PIPELINING\n250 DSN", "250 DSN"} {
+		t.Run(ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				ext + "\n250 Sender ok\n250 Ok\n550 5.1.1 No such user\n451 4.3.0 Try again later\n250 Ok\n")
+
+			var cmdbuf bytes.Buffer
+			bcmdbuf := bufio.NewWriter(&cmdbuf)
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Mail("from@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+			res, err := c.Rcpts([]RcptWithOptions{
+				{Addr: "a@example.com", Opts: &RcptOptions{Notify: []DSNNotify{DSNNotifyFailure, DSNNotifyDelay}}},
+				{Addr: "b@example.com"},
+				{Addr: "c@example.com", Opts: &RcptOptions{OriginalRecipient: "c+x=y@example.com"}},
+				{Addr: "d@example.com", Opts: &RcptOptions{Notify: []DSNNotify{DSNNotifyNever}}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bcmdbuf.Flush()
+
+			want := "EHLO localhost\r\n" +
+				"MAIL FROM:<from@example.com>\r\n" +
+				"RCPT TO:<a@example.com> NOTIFY=FAILURE,DELAY\r\n" +
+				"RCPT TO:<b@example.com>\r\n" +
+				"RCPT TO:<c@example.com> ORCPT=rfc822;c+2Bx+3Dy@example.com\r\n" +
+				"RCPT TO:<d@example.com> NOTIFY=NEVER\r\n"
+			if got := cmdbuf.String(); got != want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, want)
+			}
+
+			if len(res) != 4 || res["a@example.com"] != nil || res["d@example.com"] != nil {
+				t.Errorf("wrong result: %v", res)
+			}
+			if e := res["b@example.com"]; e == nil || e.Code != 550 || e.EnhancedCode != (EnhancedCode{5, 1, 1}) {
+				t.Errorf("wrong error for b: %#v", e)
+			}
+			if e := res["c@example.com"]; e == nil || e.Code != 451 || !e.Temporary() {
+				t.Errorf("wrong error for c: %#v", e)
+			}
+			if want := []string{"a@example.com", "d@example.com"}; !reflect.DeepEqual(c.rcpts, want) {
+				t.Errorf("wrong rcpts: %v", c.rcpts)
+			}
+		})
+	}
+
+	t.Run("never", func(t *testing.T) {
+		c := &Client{ext: map[string]string{"DSN": ""}}
+		_, err := c.Rcpts([]RcptWithOptions{{Addr: "a@example.com",
+			Opts: &RcptOptions{Notify: []DSNNotify{DSNNotifyNever, DSNNotifyDelay}}}})
+		if err == nil || !strings.Contains(err.Error(), "NEVER can't be combined") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+// The DATA response should be read correctly after pipelined RCPT responses,
+// some of which are rejections.
+func TestClientRcptsPipeliningData(t *testing.T) {
+	server := ztest.CRLF("220 hello world\n" +
+		"250-mx.example.com at your service\n" +
+		"250 PIPELINING\n" +
+		"250 Sender ok\n" +
+		"550 5.1.1 No such user\n" +
+		"250 Ok\n" +
+		"451 4.3.0 Try again later\n" +
+		"354 Go ahead\n" +
+		"250 2.0.0 Ok: queued as 3F2A\n" +
+		"221 Bye\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("from@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Rcpts([]RcptWithOptions{{Addr: "a@example.com"}, {Addr: "b@example.com"}, {Addr: "c@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["a@example.com"] == nil || res["b@example.com"] != nil || res["c@example.com"] == nil {
+		t.Errorf("wrong result: %v", res)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "Subject: x\r\n\r\nHello\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := w.CloseWithResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusText != "2.0.0 Ok: queued as 3F2A" || resp.QueueID != "3F2A" {
+		t.Errorf("wrong response: %#v", resp)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	bcmdbuf.Flush()
+	want := "EHLO localhost\r\n" +
+		"MAIL FROM:<from@example.com>\r\n" +
+		"RCPT TO:<a@example.com>\r\n" +
+		"RCPT TO:<b@example.com>\r\n" +
+		"RCPT TO:<c@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: x\r\n\r\nHello\r\n.\r\n" +
+		"QUIT\r\n"
+	if got := cmdbuf.String(); got != want {
+		t.Errorf("\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestClientAuthEquals(t *testing.T) {
+	tests := []struct {
+		ext      string
+		wantAuth []string
+		wantExt  string
+	}{
+		{"250 AUTH LOGIN PLAIN", []string{"LOGIN", "PLAIN"}, "LOGIN PLAIN"},
+		{"250 AUTH=LOGIN PLAIN", []string{"LOGIN", "PLAIN"}, "LOGIN PLAIN"},
+		{"250 AUTH=LOGIN", []string{"LOGIN"}, "LOGIN"},
+		{"250-AUTH=LOGIN PLAIN\n250 AUTH LOGIN PLAIN CRAM-MD5", []string{"LOGIN", "PLAIN", "CRAM-MD5"}, "LOGIN PLAIN CRAM-MD5"},
+		{"250-AUTH LOGIN\n250 auth=PLAIN", []string{"LOGIN", "PLAIN"}, "LOGIN PLAIN"},
+		{"250 8BITMIME", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			server := ztest.CRLF("220 hello world\n250-mx.example.com at your service\n" +
+				tt.ext + "\n")
+
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.hello(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.auth, tt.wantAuth) {
+				t.Errorf("c.auth\ngot:  %q\nwant: %q", c.auth, tt.wantAuth)
+			}
+			ok, mechs := c.Extension("AUTH")
+			if ok != (tt.wantExt != "") || mechs != tt.wantExt {
+				t.Errorf("Extension\ngot:  %t %q\nwant: %q", ok, mechs, tt.wantExt)
+			}
+			if _, ok := c.ext["AUTH=LOGIN"]; ok {
+				t.Error("AUTH=LOGIN in c.ext")
+			}
+		})
+	}
+}
+
+func TestScramSHA256Auth(t *testing.T) {
+	// Example from RFC 7677 section 3.
+	a := &scramAuth{Username: "user", Password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+
+	mech, ir, err := a.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mech != "SCRAM-SHA-256" {
+		t.Errorf("wrong mech: %q", mech)
+	}
+	if want := "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"; string(ir) != want {
+		t.Errorf("\ngot:  %q\nwant: %q", ir, want)
+	}
+
+	resp, err := a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; string(resp) != want {
+		t.Errorf("\ngot:  %q\nwant: %q", resp, want)
+	}
+
+	resp, err = a.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || len(resp) != 0 {
+		t.Errorf("want empty response, got %q", resp)
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			serverFirst, serverFinal string
+			wantErr                  string
+		}{
+			{"r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "", ErrUnexpectedServerChallenge.Error()},
+			{"r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", "", ErrUnexpectedServerChallenge.Error()},
+			{"r=rOprNGfwEbeRWgbNEkqOx,s=!!,i=4096", "", ErrUnexpectedServerChallenge.Error()},
+			{"r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=x", "", ErrUnexpectedServerChallenge.Error()},
+			{"r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1", "v=AAAA", "invalid server signature"},
+			{"r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1", "e=invalid-proof", "server error: invalid-proof"},
+			{"r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1", "x", ErrUnexpectedServerChallenge.Error()},
+		}
+		for _, tt := range tests {
+			a := &scramAuth{Username: "user", Password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+			if _, _, err := a.Start(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := a.Next([]byte(tt.serverFirst))
+			if err == nil && tt.serverFinal != "" {
+				_, err = a.Next([]byte(tt.serverFinal))
+			}
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("%s %s\ngot:  %v\nwant: %s", tt.serverFirst, tt.serverFinal, err, tt.wantErr)
+			}
+		}
+	})
+
+	mech, ir, err = ScramSHA256Auth("a,b=c", "pw").Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(ir), "n,,n=a=2Cb=3Dc,r=") || len(ir) < 30 {
+		t.Errorf("wrong initial response: %q", ir)
+	}
+}
+
+func TestScramSHA256AuthClient(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	serverFirst := "334 " + b64([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")) + "\r\n"
+	serverFinal := "334 " + b64([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")) + "\r\n"
+
+	tests := []struct {
+		name    string
+		server  string
+		wantErr string
+	}{
+		{"ok", serverFirst + serverFinal + "235 Accepted\r\n", ""},
+		{"no signature", serverFirst + "235 Accepted\r\n", "without sending its signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader("220 hello world\r\n" + tt.server), io.Discard}
+			c, err := NewClient(fake, "fake.host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.didHello = true
+
+			err = c.Auth(&scramAuth{Username: "user", Password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"})
+			if !ztest.ErrorContains(err, tt.wantErr) {
+				t.Errorf("wrong error:\ngot:  %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// slowServer is a server on a net.Pipe which responds to the commands with
+// resp, and stops responding once it runs out.
+func slowServer(t *testing.T, resp ...string) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		tc := textproto.NewConn(server)
+		tc.PrintfLine("220 hello world")
+		for _, r := range resp {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			tc.PrintfLine("%s", r)
+			if line == "DATA" {
+				if _, err := tc.ReadDotBytes(); err != nil {
+					return
+				}
+			}
+		}
+		io.Copy(io.Discard, server) // Never respond.
+	}()
+	return client
+}
+
+func TestClientTimeout(t *testing.T) {
+	t.Run("command", func(t *testing.T) {
+		c, err := NewClient(slowServer(t, "250 localhost"), "fake.host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.CommandTimeout = 50 * time.Millisecond
+
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = c.Mail("user@example.com", nil)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("wrong error: %#v", err)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("took %s", took)
+		}
+	})
+
+	t.Run("submission", func(t *testing.T) {
+		c, err := NewClient(slowServer(t, "250 localhost", "250 Ok", "250 Ok", "354 Go ahead"), "fake.host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.CommandTimeout = time.Second
+		c.SubmissionTimeout = 50 * time.Millisecond
+
+		if err := c.Mail("user@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Rcpt("to@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, "Subject: x\r\n\r\nHello\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("wrong error: %#v", err)
+		}
+	})
+}
+
+func TestDialContext(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	d := &net.Dialer{Control: func(string, string, syscall.RawConn) error { return errBlocked }}
+	_, err := DialContext(context.Background(), "127.0.0.1:25", d)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !errors.Is(err, errBlocked) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = DialContext(ctx, "127.0.0.1:25", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+}